@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/fanyang89/yaml-compose/v1/compose"
+)
+
+func newBlameCmd(deps commandDeps) *cobra.Command {
+	opts := rootOptions{}
+	cmd := &cobra.Command{
+		Use:   "blame YAML-FILE PATH",
+		Short: "Show which layers and operators set a path",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.base = args[0]
+			return runBlameCommand(cmd.Context(), opts, args[1], deps)
+		},
+	}
+	cmd.SilenceUsage = true
+
+	addComposeFlags(cmd, &opts)
+	return cmd
+}
+
+func runBlameCommand(ctx context.Context, opts rootOptions, path string, deps commandDeps) error {
+	c, err := prepareCompose(opts, deps)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, opts)
+	defer cancel()
+	entries, err := c.BlameContext(ctx, path)
+	if err != nil {
+		return fmt.Errorf("blame %s: %w", path, err)
+	}
+
+	if err := printBlame(deps.stdout, entries); err != nil {
+		return fmt.Errorf("print output: %w", err)
+	}
+	return nil
+}
+
+// printBlame writes one block per history entry:
+//
+//	1-prod.yaml operators[0] kind=merge strategy=override (base.yaml.d/1-prod.yaml:3)
+//	    - base
+//	    + prod
+func printBlame(w io.Writer, entries []compose.BlameEntry) error {
+	var out strings.Builder
+	for _, entry := range entries {
+		out.WriteString(blameHeader(entry))
+		out.WriteByte('\n')
+
+		if entry.Layer == "" {
+			fmt.Fprintf(&out, "    = %s\n", blameValue(entry.New, entry.NewSet))
+			continue
+		}
+		fmt.Fprintf(&out, "    - %s\n", blameValue(entry.Old, entry.OldSet))
+		fmt.Fprintf(&out, "    + %s\n", blameValue(entry.New, entry.NewSet))
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+func blameHeader(entry compose.BlameEntry) string {
+	parts := make([]string, 0, 4)
+	switch {
+	case entry.Layer == "":
+		parts = append(parts, "base")
+	case entry.Operator < 0:
+		parts = append(parts, entry.Layer)
+	default:
+		parts = append(parts, fmt.Sprintf("%s operators[%d]", entry.Layer, entry.Operator))
+	}
+	if entry.Kind != "" {
+		parts = append(parts, "kind="+entry.Kind)
+	}
+	if entry.Strategy != "" {
+		parts = append(parts, "strategy="+entry.Strategy)
+	}
+	if origin := entry.Origin; origin.Layer != "" && (origin.Layer != entry.Layer || origin.Operator != entry.Operator) {
+		parts = append(parts, "via "+origin.String())
+	}
+	if entry.Origin.File != "" {
+		location := entry.Origin.File
+		if entry.Origin.Line > 0 {
+			location = fmt.Sprintf("%s:%d", location, entry.Origin.Line)
+		}
+		parts = append(parts, "("+location+")")
+	}
+	return strings.Join(parts, " ")
+}
+
+func blameValue(value string, set bool) string {
+	if !set {
+		return "<unset>"
+	}
+	return value
+}
@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
@@ -15,10 +18,19 @@ import (
 )
 
 type composeRunner interface {
-	Run() (string, error)
+	RunContext(context.Context) (string, error)
 	SetTransformLogWriter(io.Writer)
 	SetTemplateVars(map[string]string)
 	SetLayerDir(string)
+	SetLayerDirs([]string, compose.DiscoverOptions)
+	SetProfiles(...string)
+	SetLayerSelection(compose.LayerSelection)
+	SelectedLayers() ([]string, error)
+	SetAnnotate(bool)
+	SetTraceSink(compose.TraceSink)
+	SetMarshaller(compose.MarshalFunc)
+	BlameContext(context.Context, string) ([]compose.BlameEntry, error)
+	ValidateContext(context.Context) error
 }
 
 type commandDeps struct {
@@ -39,12 +51,27 @@ func defaultCommandDeps() commandDeps {
 	}
 }
 
+type rootOptions struct {
+	base      string
+	layerDirs []string
+	profiles  []string
+	output    string
+	layer     string
+	from      string
+	until     string
+	skip      []string
+	verbose   bool
+	vars      []string
+	annotate  bool
+	traceDir  string
+	format    string
+	flatten   compose.FlattenOptions
+	timeout   time.Duration
+}
+
 func newRootCmd(deps commandDeps) *cobra.Command {
-	flagOutput := ""
+	opts := rootOptions{}
 	flagBase := ""
-	flagLayerDir := ""
-	flagLayer := ""
-	flagVars := []string{}
 	cmd := &cobra.Command{
 		Use:  "yaml-compose [YAML-FILE]",
 		Args: cobra.MaximumNArgs(1),
@@ -53,102 +80,196 @@ func newRootCmd(deps commandDeps) *cobra.Command {
 			if err != nil {
 				return err
 			}
-			return runRootCommand(base, flagLayerDir, flagOutput, flagLayer, flagVars, deps)
+			opts.base = base
+			return runRootCommand(cmd.Context(), opts, deps)
 		},
 	}
 	cmd.SilenceUsage = true
 
 	cmd.Flags().StringVar(&flagBase, "base", "", "base yaml file path")
-	cmd.Flags().StringVar(&flagLayerDir, "layer-dir", "", "layer yaml directory path")
-	cmd.Flags().StringVarP(&flagOutput, "output", "o", "", "config file")
-	cmd.Flags().StringVar(&flagLayer, "layer", "", "run only one layer file (for debugging)")
-	cmd.Flags().StringArrayVar(&flagVars, "var", nil, "template variable in KEY=VALUE format (repeatable)")
+	addComposeFlags(cmd, &opts)
+	cmd.Flags().StringVarP(&opts.output, "output", "o", "", "config file")
+	cmd.Flags().StringVar(&opts.format, "format", "yaml", "output format: yaml, json, json-compact, env or properties")
+	cmd.Flags().StringVar(&opts.flatten.Separator, "flat-separator", "", "key separator for env and properties output (default \"_\" for env, \".\" for properties)")
+	cmd.Flags().StringVar((*string)(&opts.flatten.KeyCase), "flat-key-case", "", "key case for env and properties output: preserve, upper or lower")
+	cmd.Flags().StringVar(&opts.flatten.Prefix, "flat-prefix", "", "prefix for env and properties keys")
+	cmd.Flags().StringVar((*string)(&opts.flatten.ListIndex), "flat-list", "", "list style for env and properties output: segment, bracket or json")
+	cmd.Flags().StringVar((*string)(&opts.flatten.Quote), "flat-quote", "", "env value quoting: auto, double, single or none")
+	cmd.Flags().StringVar((*string)(&opts.flatten.Unrepresentable), "flat-fallback", "", "env and properties values without a flat form: error or json")
+	cmd.Flags().BoolVar(&opts.annotate, "annotate", false, "annotate output values with the layer and operator that set them")
+	cmd.Flags().StringVar(&opts.traceDir, "trace-dir", "", "write the state and a diff after every layer and operator into this directory")
+
+	cmd.AddCommand(newBlameCmd(deps))
+	cmd.AddCommand(newValidateCmd(deps))
 	return cmd
 }
 
-func runRootCommand(base, layerDir, output, layer string, rawVars []string, deps commandDeps) error {
-	exists, err := fsutils.FileExistsOn(deps.fs, base)
+// addComposeFlags registers the flags shared by every command that composes
+// layers.
+func addComposeFlags(cmd *cobra.Command, opts *rootOptions) {
+	cmd.Flags().StringArrayVar(&opts.layerDirs, "layer-dir", nil, "layer yaml directory path (repeatable; default <base>.d)")
+	cmd.Flags().StringVar(&opts.layer, "layer", "", "run only the layers matching this name or glob, e.g. '2-*' (for debugging)")
+	cmd.Flags().StringVar(&opts.from, "from", "", "skip the layers before the first layer matching this name or glob")
+	cmd.Flags().StringVar(&opts.until, "until", "", "skip the layers after the last layer matching this name or glob")
+	cmd.Flags().StringArrayVar(&opts.skip, "skip", nil, "skip the layers matching this name or glob (repeatable)")
+	cmd.Flags().BoolVarP(&opts.verbose, "verbose", "v", false, "print the selected layers on stderr")
+	cmd.Flags().StringArrayVar(&opts.profiles, "profile", nil, "activate a profile: its subdirectory of the layer directories and the layers tagged with it (repeatable)")
+	cmd.Flags().StringArrayVar(&opts.vars, "var", nil, "template variable in KEY=VALUE format (repeatable)")
+	cmd.Flags().DurationVar(&opts.timeout, "timeout", 0, "give up composing after this duration, e.g. 30s (0 disables the timeout)")
+}
+
+// withTimeout returns ctx limited by --timeout.
+func withTimeout(ctx context.Context, opts rootOptions) (context.Context, context.CancelFunc) {
+	if opts.timeout > 0 {
+		return context.WithTimeout(ctx, opts.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func runRootCommand(ctx context.Context, opts rootOptions, deps commandDeps) error {
+	marshal, err := outputMarshaller(opts.format, opts.flatten)
 	if err != nil {
-		return fmt.Errorf("check base file: %w", err)
+		return err
 	}
-	if !exists {
-		return fmt.Errorf("%s not found", base)
+
+	c, err := prepareCompose(opts, deps)
+	if err != nil {
+		return err
+	}
+	c.SetMarshaller(marshal)
+	c.SetAnnotate(opts.annotate)
+	if opts.traceDir != "" {
+		c.SetTraceSink(compose.NewDirTraceSink(deps.fs, opts.traceDir))
+	}
+	ctx, cancel := withTimeout(ctx, opts)
+	defer cancel()
+	ret, err := c.RunContext(ctx)
+	if err != nil {
+		return fmt.Errorf("compose files: %w", err)
+	}
+
+	if opts.output != "" {
+		outputBaseDir := filepath.Dir(opts.output)
+		if err := deps.fs.MkdirAll(outputBaseDir, 0755); err != nil {
+			return fmt.Errorf("create output directory: %w", err)
+		}
+		err = afero.WriteFile(deps.fs, opts.output, []byte(ret), 0644)
+		if err != nil {
+			return fmt.Errorf("write output file: %w", err)
+		}
+		return nil
 	}
 
-	resolvedLayerDir := layerDir
-	if resolvedLayerDir == "" {
-		resolvedLayerDir = base + ".d"
+	if _, err := fmt.Fprintln(deps.stdout, ret); err != nil {
+		return fmt.Errorf("print output: %w", err)
 	}
+	return nil
+}
 
-	exists, err = fsutils.DirExistsOn(deps.fs, resolvedLayerDir)
+// prepareCompose validates the base file and layer directories and returns a
+// composer configured from opts.  Layers of a single directory keep their
+// filenames as names; with several directories the composer discovers them
+// itself and names them by path.  The layer selection flags are resolved by
+// the composer after the layers are sorted.
+func prepareCompose(opts rootOptions, deps commandDeps) (composeRunner, error) {
+	base := opts.base
+	exists, err := fsutils.FileExistsOn(deps.fs, base)
 	if err != nil {
-		return fmt.Errorf("check layer directory: %w", err)
+		return nil, fmt.Errorf("check base file: %w", err)
 	}
 	if !exists {
-		return fmt.Errorf("%s not found", resolvedLayerDir)
+		return nil, fmt.Errorf("%s not found", base)
 	}
 
-	layerInfos, err := afero.ReadDir(deps.fs, resolvedLayerDir)
-	if err != nil {
-		return fmt.Errorf("read layer directory: %w", err)
+	layerDirs := opts.layerDirs
+	if len(layerDirs) == 0 {
+		layerDirs = []string{base + ".d"}
 	}
-	layers := collectLayerFilenames(layerInfos)
-	if layer != "" {
-		layers, err = filterLayersByName(layers, layer)
+	for _, layerDir := range layerDirs {
+		exists, err = fsutils.DirExistsOn(deps.fs, layerDir)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("check layer directory: %w", err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("%s not found", layerDir)
 		}
 	}
 
-	templateVars, err := parseTemplateVars(rawVars)
+	templateVars, err := parseTemplateVars(opts.vars)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	c := deps.newCompose(base, layers, deps.fs)
+	var c composeRunner
+	if len(layerDirs) == 1 {
+		layers, err := compose.DiscoverLayers(deps.fs, layerDirs[0], compose.DiscoverOptions{Profiles: opts.profiles})
+		if err != nil {
+			return nil, fmt.Errorf("discover layers: %w", err)
+		}
+		c = deps.newCompose(base, layers, deps.fs)
+		c.SetLayerDir(layerDirs[0])
+	} else {
+		c = deps.newCompose(base, nil, deps.fs)
+		c.SetLayerDirs(layerDirs, compose.DiscoverOptions{})
+	}
+	c.SetProfiles(opts.profiles...)
+	c.SetLayerSelection(layerSelection(opts))
 	c.SetTransformLogWriter(deps.stderr)
 	c.SetTemplateVars(templateVars)
-	c.SetLayerDir(resolvedLayerDir)
-	ret, err := c.Run()
+
+	selected, err := c.SelectedLayers()
 	if err != nil {
-		return fmt.Errorf("compose files: %w", err)
+		return nil, fmt.Errorf("select layers: %w", err)
 	}
-
-	if output != "" {
-		outputBaseDir := filepath.Dir(output)
-		if err := deps.fs.MkdirAll(outputBaseDir, 0755); err != nil {
-			return fmt.Errorf("create output directory: %w", err)
-		}
-		err = afero.WriteFile(deps.fs, output, []byte(ret), 0644)
-		if err != nil {
-			return fmt.Errorf("write output file: %w", err)
+	if opts.verbose {
+		if err := printSelectedLayers(deps.stderr, selected); err != nil {
+			return nil, err
 		}
-		return nil
 	}
+	return c, nil
+}
 
-	if _, err := fmt.Fprintln(deps.stdout, ret); err != nil {
-		return fmt.Errorf("print output: %w", err)
+func layerSelection(opts rootOptions) compose.LayerSelection {
+	sel := compose.LayerSelection{From: opts.from, Until: opts.until, Skip: opts.skip}
+	if opts.layer != "" {
+		sel.Only = []string{opts.layer}
 	}
-	return nil
+	return sel
 }
 
-func filterLayersByName(layers []string, target string) ([]string, error) {
+func printSelectedLayers(w io.Writer, layers []string) error {
+	if _, err := fmt.Fprintf(w, "selected %d layers:\n", len(layers)); err != nil {
+		return fmt.Errorf("print selected layers: %w", err)
+	}
 	for _, layer := range layers {
-		if layer == target {
-			return []string{layer}, nil
+		if _, err := fmt.Fprintf(w, "  %s\n", layer); err != nil {
+			return fmt.Errorf("print selected layers: %w", err)
 		}
 	}
-	return nil, fmt.Errorf("layer %q not found", target)
+	return nil
 }
 
-func collectLayerFilenames(layerInfos []os.FileInfo) []string {
-	layers := make([]string, 0)
-	for _, info := range layerInfos {
-		if strings.HasSuffix(info.Name(), ".yaml") || strings.HasSuffix(info.Name(), ".yml") {
-			layers = append(layers, info.Name())
-		}
+func outputMarshaller(format string, flatten compose.FlattenOptions) (compose.MarshalFunc, error) {
+	var marshal compose.MarshalFunc
+	var err error
+	switch format {
+	case "yaml":
+		return compose.MarshalYAML, nil
+	case "json":
+		return compose.MarshalJSON, nil
+	case "json-compact":
+		return compose.MarshalJSONCompact, nil
+	case "env":
+		marshal, err = compose.NewEnvMarshaller(flatten)
+	case "properties":
+		marshal, err = compose.NewPropertiesMarshaller(flatten)
+	default:
+		return nil, fmt.Errorf("invalid --format %q: supported values: yaml, json, json-compact, env, properties", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid --format %s options: %w", format, err)
 	}
-	return layers
+	return marshal, nil
 }
 
 func parseTemplateVars(rawVars []string) (map[string]string, error) {
@@ -193,6 +314,9 @@ var rootCmd = newRootCmd(defaultCommandDeps())
 
 var osExit = os.Exit
 
+// Execute runs the root command.  SIGINT cancels a running composition.
 func Execute() {
-	execute(rootCmd.Execute, osExit)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	execute(func() error { return rootCmd.ExecuteContext(ctx) }, osExit)
 }
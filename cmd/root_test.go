@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"os"
@@ -11,6 +12,8 @@ import (
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/require"
+
+	"github.com/fanyang89/yaml-compose/v1/compose"
 )
 
 type fakeComposer struct {
@@ -24,7 +27,7 @@ func (errorWriter) Write([]byte) (int, error) {
 	return 0, errors.New("write stdout failed")
 }
 
-func (f fakeComposer) Run() (string, error) {
+func (f fakeComposer) RunContext(context.Context) (string, error) {
 	return f.run()
 }
 
@@ -38,6 +41,30 @@ func (f fakeComposer) SetTemplateVars(vars map[string]string) {
 
 func (f fakeComposer) SetLayerDir(string) {}
 
+func (f fakeComposer) SetLayerDirs([]string, compose.DiscoverOptions) {}
+
+func (f fakeComposer) SetProfiles(...string) {}
+
+func (f fakeComposer) SetLayerSelection(compose.LayerSelection) {}
+
+func (f fakeComposer) SelectedLayers() ([]string, error) {
+	return nil, nil
+}
+
+func (f fakeComposer) SetAnnotate(bool) {}
+
+func (f fakeComposer) SetTraceSink(compose.TraceSink) {}
+
+func (f fakeComposer) SetMarshaller(compose.MarshalFunc) {}
+
+func (f fakeComposer) BlameContext(context.Context, string) ([]compose.BlameEntry, error) {
+	return nil, errors.New("blame is not supported")
+}
+
+func (f fakeComposer) ValidateContext(context.Context) error {
+	return nil
+}
+
 func setupComposeFiles(t *testing.T, fs afero.Fs) string {
 	t.Helper()
 
@@ -100,6 +127,249 @@ func TestRootCmdPrintsWhenOutputFlagMissing(t *testing.T) {
 	require.Contains(out.String(), "service: layer")
 }
 
+func TestRootCmdAnnotatesOutput(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+	var out bytes.Buffer
+
+	cmd := newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base, "--annotate"})
+	err := cmd.Execute()
+	require.NoError(err)
+	require.Contains(out.String(), "service: layer # from 1-layer.yaml")
+}
+
+func TestRootCmdFormatsOutputAsJSON(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	var out bytes.Buffer
+	cmd := newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base, "--format", "json-compact"})
+	err := cmd.Execute()
+	require.NoError(err)
+	require.Equal("{\"service\":\"layer\"}\n\n", out.String())
+}
+
+func TestRootCmdFormatsOutputAsEnv(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	var out bytes.Buffer
+	cmd := newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base, "--format", "env", "--flat-prefix", "APP"})
+	err := cmd.Execute()
+	require.NoError(err)
+	require.Equal("APP_SERVICE=layer\n\n", out.String())
+}
+
+func TestRootCmdFailsForInvalidFlattenOptions(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{base, "--format", "properties", "--flat-list", "dots"})
+	err := cmd.Execute()
+	require.Error(err)
+	require.Contains(err.Error(), `invalid --format properties options: invalid list index style "dots"`)
+}
+
+func TestRootCmdFailsWhenTimeoutExpires(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{base, "--timeout", "1ns"})
+	err := cmd.Execute()
+	require.Error(err)
+	require.ErrorIs(err, context.DeadlineExceeded)
+}
+
+func TestRootCmdPassesContextToCompose(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{base})
+	err := cmd.ExecuteContext(ctx)
+	require.ErrorIs(err, context.Canceled)
+}
+
+func TestRootCmdStacksRepeatedLayerDirs(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+	err := afero.WriteFile(fs, "/defaults.d/1-platform.yaml", []byte("service: platform\nlog: info\n"), 0644)
+	require.NoError(err)
+	err = afero.WriteFile(fs, "/defaults.d/2-platform.yaml", []byte("log: warn\n"), 0644)
+	require.NoError(err)
+
+	var out bytes.Buffer
+	cmd := newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base, "--layer-dir", "/defaults.d", "--layer-dir", "/base.yaml.d"})
+	err = cmd.Execute()
+	require.NoError(err)
+	require.Equal("service: layer\nlog: warn\n\n", out.String())
+
+	out.Reset()
+	cmd = newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base, "--layer-dir", "/defaults.d", "--layer-dir", "/base.yaml.d", "--layer", "2-platform.yaml"})
+	err = cmd.Execute()
+	require.NoError(err)
+	require.Equal("service: base\nlog: warn\n\n", out.String())
+
+	cmd = newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{base, "--layer-dir", "/defaults.d", "--layer-dir", "/missing.d"})
+	err = cmd.Execute()
+	require.Error(err)
+	require.Contains(err.Error(), "/missing.d not found")
+}
+
+func TestRootCmdAppliesProfileSubdirectories(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+	files := map[string]string{
+		"/base.yaml.d/2-common.yaml":            "replicas: 1\nregion: none\n",
+		"/base.yaml.d/prod/1-prod.yaml":         "replicas: 3\n",
+		"/base.yaml.d/prod/3-prod.yaml":         "tier: prod\n",
+		"/base.yaml.d/region-eu/2-region.yaml":  "region: eu\n",
+		"/base.yaml.d/prod/region-eu/4-eu.yaml": "tier: prod-eu\n",
+		"/base.yaml.d/staging/1-staging.yaml":   "replicas: 2\n",
+	}
+	for name, content := range files {
+		require.NoError(afero.WriteFile(fs, name, []byte(content), 0644))
+	}
+
+	var out bytes.Buffer
+	cmd := newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base})
+	require.NoError(cmd.Execute())
+	require.Equal("service: layer\nreplicas: 1\nregion: none\n\n", out.String())
+
+	out.Reset()
+	cmd = newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base, "--profile", "prod", "--profile", "region-eu"})
+	require.NoError(cmd.Execute())
+	require.Equal("service: layer\nreplicas: 1\nregion: eu\ntier: prod-eu\n\n", out.String())
+
+	out.Reset()
+	cmd = newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base, "--profile", "prod", "--layer", "prod/3-prod.yaml"})
+	require.NoError(cmd.Execute())
+	require.Equal("service: base\ntier: prod\n\n", out.String())
+}
+
+func TestRootCmdAppliesLayersTaggedWithProfile(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+	err := afero.WriteFile(fs, "/base.yaml.d/2-prod.yaml", []byte("profiles: [prod, staging]\n---\nreplicas: 3\n"), 0644)
+	require.NoError(err)
+
+	var out bytes.Buffer
+	cmd := newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base})
+	require.NoError(cmd.Execute())
+	require.Equal("service: layer\n\n", out.String())
+
+	out.Reset()
+	cmd = newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{base, "--profile", "staging"})
+	require.NoError(cmd.Execute())
+	require.Equal("service: layer\nreplicas: 3\n\n", out.String())
+}
+
+func TestRootCmdSelectsLayersForBisecting(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+	for name, content := range map[string]string{
+		"/base.yaml.d/2-a.yaml":       "a: 2\n",
+		"/base.yaml.d/2-b.yaml":       "b: 2\n",
+		"/base.yaml.d/3-feature.yaml": "feature: true\n",
+		"/base.yaml.d/4-final.yaml":   "final: true\n",
+	} {
+		require.NoError(afero.WriteFile(fs, name, []byte(content), 0644))
+	}
+
+	run := func(args ...string) (string, string, error) {
+		var out, stderr bytes.Buffer
+		cmd := newTestRootCmd(fs, &out, func(deps *commandDeps) {
+			deps.stderr = &stderr
+		})
+		cmd.SetArgs(append([]string{base}, args...))
+		err := cmd.Execute()
+		return out.String(), stderr.String(), err
+	}
+
+	out, stderr, err := run("--from", "2-b.yaml", "--until", "3-feature.yaml", "-v")
+	require.NoError(err)
+	require.Equal("service: base\nb: 2\nfeature: true\n\n", out)
+	require.Equal("selected 2 layers:\n  2-b.yaml\n  3-feature.yaml\n", stderr)
+
+	out, stderr, err = run("--layer", "2-*", "--skip", "2-a.yaml")
+	require.NoError(err)
+	require.Equal("service: base\nb: 2\n\n", out)
+	require.Empty(stderr)
+
+	out, _, err = run("--skip", "1-*", "--skip", "[34]-*")
+	require.NoError(err)
+	require.Equal("service: base\na: 2\nb: 2\n\n", out)
+
+	_, _, err = run("--until", "9-*")
+	require.Error(err)
+	require.Contains(err.Error(), `select layers: until layer "9-*" not found`)
+
+	out, _, err = run("--from", "3-feature.yaml", "--until", "2-a.yaml")
+	require.Error(err)
+	require.Contains(err.Error(), `select layers: from layer "3-feature.yaml" comes after until layer "2-a.yaml"`)
+	require.Empty(out)
+}
+
+func TestRootCmdFailsForInvalidFormat(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{base, "--format", "xml"})
+	err := cmd.Execute()
+	require.Error(err)
+	require.Contains(err.Error(), `invalid --format "xml"`)
+}
+
+func TestRootCmdWritesTraceDir(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{base, "--trace-dir", "/trace"})
+	err := cmd.Execute()
+	require.NoError(err)
+
+	b, err := afero.ReadFile(fs, "/trace/000-base.yaml")
+	require.NoError(err)
+	require.Equal("service: base\n", string(b))
+
+	b, err = afero.ReadFile(fs, "/trace/001-1-layer.yaml.op0-merge.diff")
+	require.NoError(err)
+	require.Contains(string(b), "-service: base\n+service: layer\n")
+
+	exists, err := afero.Exists(fs, "/trace/002-1-layer.yaml.yaml")
+	require.NoError(err)
+	require.True(exists)
+}
+
 func TestRootCmdRunsOnlySpecifiedLayer(t *testing.T) {
 	require := require.New(t)
 	fs := afero.NewMemMapFs()
@@ -374,32 +644,139 @@ func TestRootCmdFailsWhenWriteOutputFails(t *testing.T) {
 	require.Contains(err.Error(), "write output file")
 }
 
-func TestCollectLayerFilenames(t *testing.T) {
+func TestBlameCmdPrintsPathHistory(t *testing.T) {
 	require := require.New(t)
 	fs := afero.NewMemMapFs()
-	err := afero.WriteFile(fs, "/1-a.yaml", []byte("a: 1\n"), 0644)
-	require.NoError(err)
-	err = afero.WriteFile(fs, "/2-b.yml", []byte("b: 2\n"), 0644)
+	base := setupComposeFiles(t, fs)
+	var out bytes.Buffer
+
+	cmd := newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{"blame", base, "service"})
+	err := cmd.Execute()
 	require.NoError(err)
-	err = afero.WriteFile(fs, "/3-c.txt", []byte("c: 3\n"), 0644)
+	require.Equal(`base (/base.yaml:1)
+    = base
+1-layer.yaml kind=merge strategy=override (/base.yaml.d/1-layer.yaml:1)
+    - base
+    + layer
+`, out.String())
+}
+
+func TestBlameCmdFailsForInvalidPath(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{"blame", base, "a..b"})
+	err := cmd.Execute()
+	require.Error(err)
+	require.Contains(err.Error(), "invalid blame path")
+
+	var pathErr *compose.PathError
+	require.ErrorAs(err, &pathErr)
+	require.Equal("a..b", pathErr.Path)
+}
+
+func TestBlameCmdFailsWhenTimeoutExpires(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{"blame", base, "service", "--timeout", "1ns"})
+	err := cmd.Execute()
+	require.ErrorIs(err, context.DeadlineExceeded)
+}
+
+func TestRootCmdReturnsTypedComposeErrors(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+	err := afero.WriteFile(fs, base+".d/2-ops.yaml", []byte(`operators:
+  - kind: list_filter
+    source:
+      from: nowhere
+      path: service
+---
+`), 0644)
 	require.NoError(err)
 
-	infos, err := afero.ReadDir(fs, "/")
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{base})
+	err = cmd.Execute()
+	require.Error(err)
+
+	var configErr *compose.OperatorConfigError
+	require.ErrorAs(err, &configErr)
+	require.Equal("2-ops.yaml", configErr.Layer)
+	require.Equal("operators[0].source.from", configErr.Field)
+	require.Equal(4, configErr.Line)
+	require.Equal(13, configErr.Column)
+}
+
+func TestValidateCmdPrintsOKForValidLayers(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	var out bytes.Buffer
+	cmd := newTestRootCmd(fs, &out, nil)
+	cmd.SetArgs([]string{"validate", base})
+	err := cmd.Execute()
 	require.NoError(err)
-	layers := collectLayerFilenames(infos)
-	require.ElementsMatch([]string{"1-a.yaml", "2-b.yml"}, layers)
+	require.Equal("ok\n", out.String())
 }
 
-func TestFilterLayersByName(t *testing.T) {
+func TestValidateCmdPassesContextToCompose(t *testing.T) {
 	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{"validate", base})
+	err := cmd.ExecuteContext(ctx)
+	require.ErrorIs(err, context.Canceled)
+}
 
-	got, err := filterLayersByName([]string{"1-a.yaml", "2-b.yaml"}, "2-b.yaml")
+func TestValidateCmdReportsAllProblems(t *testing.T) {
+	require := require.New(t)
+	fs := afero.NewMemMapFs()
+	base := setupComposeFiles(t, fs)
+	err := afero.WriteFile(fs, base+".d/2-ops.yaml", []byte(`operators:
+  - kind: list_filter
+    source:
+      from: nowhere
+      path: service
+  - kind: list_filter
+    source:
+      file: missing.yaml
+      path: service
+  - kind: list_filter
+    source:
+      from: state
+      path: a..b
+---
+`), 0644)
+	require.NoError(err)
+	err = afero.WriteFile(fs, base+".d/3-bad.yaml", []byte("a: [\n"), 0644)
 	require.NoError(err)
-	require.Equal([]string{"2-b.yaml"}, got)
 
-	_, err = filterLayersByName([]string{"1-a.yaml", "2-b.yaml"}, "3-c.yaml")
+	cmd := newTestRootCmd(fs, io.Discard, nil)
+	cmd.SetArgs([]string{"validate", base})
+	err = cmd.Execute()
 	require.Error(err)
-	require.Contains(err.Error(), "not found")
+	require.Contains(err.Error(), "found 4 problem(s)")
+	require.Contains(err.Error(), "invalid operators[0].source.from")
+	require.Contains(err.Error(), "invalid operators[2].source.path")
+	require.Contains(err.Error(), `invalid operators[1].source.file "missing.yaml": failed to read transform source file "/missing.yaml"`)
+	require.Contains(err.Error(), `failed to parse layer compose file "/base.yaml.d/3-bad.yaml"`)
+
+	var validationErr *compose.ValidationError
+	require.ErrorAs(err, &validationErr)
+	require.Len(validationErr.Errors, 4)
 }
 
 func TestExecuteRunsCommandExecutor(t *testing.T) {
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func newValidateCmd(deps commandDeps) *cobra.Command {
+	opts := rootOptions{}
+	cmd := &cobra.Command{
+		Use:   "validate YAML-FILE",
+		Short: "Check the base file and every layer and report all problems",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.base = args[0]
+			return runValidateCommand(cmd.Context(), opts, deps)
+		},
+	}
+	cmd.SilenceUsage = true
+
+	addComposeFlags(cmd, &opts)
+	return cmd
+}
+
+func runValidateCommand(ctx context.Context, opts rootOptions, deps commandDeps) error {
+	c, err := prepareCompose(opts, deps)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, opts)
+	defer cancel()
+	if err := c.ValidateContext(ctx); err != nil {
+		return fmt.Errorf("validate %s: %w", opts.base, err)
+	}
+
+	if _, err := fmt.Fprintln(deps.stdout, "ok"); err != nil {
+		return fmt.Errorf("print output: %w", err)
+	}
+	return nil
+}
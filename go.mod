@@ -3,6 +3,8 @@ module github.com/fanyang89/yaml-compose
 go 1.26.0
 
 require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/spf13/afero v1.15.0
 	github.com/spf13/cobra v1.10.2
 	github.com/stretchr/testify v1.11.1
@@ -12,7 +14,6 @@ require (
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.10 // indirect
 	golang.org/x/text v0.34.0 // indirect
 )
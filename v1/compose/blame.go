@@ -0,0 +1,163 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BlameEntry is one step in the history of a composed path: the base value
+// or a layer operator that changed it.
+type BlameEntry struct {
+	// Layer is the layer filename; empty for the base entry.
+	Layer string
+	// Operator is the index in the layer's operators list, or -1 for the
+	// base entry and the implicit merge operator.
+	Operator int
+	// Kind is the operator kind; empty for the base entry.
+	Kind string
+	// Strategy is the merge strategy resolved for the path (deep, override,
+	// append or prepend), inline directives included; empty when the step
+	// did not merge.
+	Strategy string
+	// Old and New are single-line YAML renderings of the value before and
+	// after the step.  OldSet and NewSet report whether the path existed.
+	Old    string
+	OldSet bool
+	New    string
+	NewSet bool
+	// Origin is where the new value was read from; for a map or list, where
+	// its newest value was read from.
+	Origin Origin
+}
+
+// Blame composes the layers and returns the history of rawPath: the base
+// value followed by every layer operator that changed it.  rawPath uses the
+// same syntax as operator paths, including [name=api] selectors.
+func (c *Compose) Blame(rawPath string) ([]BlameEntry, error) {
+	return c.BlameContext(context.Background(), rawPath)
+}
+
+// BlameContext is Blame giving up with ctx.Err() once ctx is done, like
+// RunContext.
+func (c *Compose) BlameContext(ctx context.Context, rawPath string) ([]BlameEntry, error) {
+	path, err := splitDotPath(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blame path %q: %w", rawPath, err)
+	}
+
+	entries := make([]BlameEntry, 0)
+	var prevNode *yaml.Node
+	prevRendered := ""
+	prevSet := false
+
+	run := c.newRun()
+	run.observer = func(step composeStep) error {
+		if step.kind == stepLayer || step.skipped {
+			return nil
+		}
+
+		node, found := getValueAtPath(step.state, path)
+		rendered := ""
+		if found {
+			rendered = renderInlineYAML(node)
+		}
+
+		if step.kind == stepOperator && found == prevSet && node == prevNode && rendered == prevRendered {
+			return nil
+		}
+
+		entry := BlameEntry{
+			Layer:    step.layer,
+			Operator: step.operatorIndex,
+			Old:      prevRendered,
+			OldSet:   prevSet,
+			New:      rendered,
+			NewSet:   found,
+		}
+		if step.operator != nil {
+			entry.Kind = step.operator.kind
+			if step.operator.implicit {
+				entry.Operator = -1
+			}
+			if step.operator.kind == transformKindMerge && found {
+				entry.Strategy = resolvedStrategyName(step.operator.merge, step.directives, path, node)
+			}
+		}
+		if found {
+			entry.Origin, _ = run.provenance.origin(node)
+		}
+		entries = append(entries, entry)
+
+		prevNode, prevRendered, prevSet = node, rendered, found
+		return nil
+	}
+
+	if _, err := run.composeDocument(ctx); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// resolvedStrategyName names the strategy a merge applied to the value at
+// path, with the inline directives the merge applied winning over its rules.
+// A map override, keep or strict on an enclosing path wins over the path's
+// own rule, and so does replace_keys on the parent.
+func resolvedStrategyName(strategy layerMergeStrategy, directives map[string]mergeDirective, path []string, value *yaml.Node) string {
+	resolve := func(path []string) mergeStrategy {
+		resolved := strategy.resolve(path)
+		if directive, ok := directives[normalizePath(path)]; ok && resolved.Map != mapMergeStrict {
+			resolved = directive.apply(resolved)
+		}
+		return resolved
+	}
+
+	for i := 0; i < len(path); i++ {
+		switch m := resolve(path[:i]).Map; {
+		case m == mapMergeOverride && i > 0, m == mapMergeKeep, m == mapMergeStrict:
+			return string(m)
+		case m == mapMergeReplaceKeys && i == len(path)-1:
+			return string(m)
+		}
+	}
+
+	if directives[normalizePath(path)].tag == directiveKeep {
+		return string(mapMergeKeep)
+	}
+	resolved := resolve(path)
+	switch {
+	case isMappingNode(value):
+		return string(resolved.Map)
+	case isSequenceNode(value):
+		return string(resolved.List)
+	default:
+		return "override"
+	}
+}
+
+// renderInlineYAML renders n as single-line flow YAML without comments.
+func renderInlineYAML(n *yaml.Node) string {
+	inline := cloneNode(n)
+	flattenNodeStyle(inline)
+	if inline.Kind == yaml.MappingNode || inline.Kind == yaml.SequenceNode {
+		inline.Style |= yaml.FlowStyle
+	}
+
+	out, err := yaml.Marshal(inline)
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func flattenNodeStyle(n *yaml.Node) {
+	n.HeadComment, n.LineComment, n.FootComment = "", "", ""
+	if n.Kind == yaml.ScalarNode {
+		n.Style &^= yaml.LiteralStyle | yaml.FoldedStyle
+	}
+	for _, child := range n.Content {
+		flattenNodeStyle(child)
+	}
+}
@@ -2,24 +2,81 @@ package compose
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path/filepath"
-	"sort"
 	"text/template"
 
 	"github.com/spf13/afero"
 	"gopkg.in/yaml.v3"
 )
 
+// Compose composes a base file with its layers.  Runs keep their state to
+// themselves, so several goroutines may run the same Compose at once; the
+// Set methods and fields must not be changed while a run is in progress.
 type Compose struct {
 	Base     string
 	Layers   []string
 	LayerDir string
-	fs       *afero.Afero
-	marshal  marshalFunc
-	logOut   io.Writer
-	tplVars  map[string]string
+	// LayerDirs are directories whose layers are discovered on every run
+	// and stacked with Layers.  Layers with the same order prefix are
+	// applied in the order of their directories, then by name.
+	LayerDirs    []string
+	fs           *afero.Afero
+	marshal      MarshalFunc
+	logOut       io.Writer
+	tplVars      map[string]string
+	annotate     bool
+	traceSink    TraceSink
+	strictDecode bool
+	memoryBase   *MemoryFile
+	memoryLayers []MemoryLayer
+	layerFilter  DiscoverOptions
+	profiles     []string
+	// discoverLayerDir makes every run discover the layers of the layer
+	// directory, as NewFromFS asks for.
+	discoverLayerDir bool
+	selection        LayerSelection
+}
+
+// Options configures a Compose created by NewWithOptions.
+type Options struct {
+	// Base is the base file path.
+	Base string
+	// Layers are the layer filenames, applied in layer order.
+	Layers []string
+	// LayerDir is the directory holding the layers; "<Base>.d" when empty.
+	LayerDir string
+	// LayerDirs are directories whose layers are discovered on every run.
+	LayerDirs []string
+	// LayerFilter narrows the layers discovered in LayerDirs.
+	LayerFilter DiscoverOptions
+	// Profiles are the active profiles, see SetProfiles.
+	Profiles []string
+	// LayerSelection narrows the sorted layer stack.
+	LayerSelection LayerSelection
+	// Fs is the filesystem files are read from; the OS filesystem when nil.
+	Fs afero.Fs
+	// TemplateVars enables layer templating with these variables.
+	TemplateVars map[string]string
+	// TransformLogWriter receives the output of replace_values
+	// print_original; discarded when nil.
+	TransformLogWriter io.Writer
+	// Marshaller renders the output of Run; MarshalYAML when nil.
+	Marshaller MarshalFunc
+	// Annotate adds "# from <layer> operators[i]" comments to the output.
+	Annotate bool
+	// TraceSink receives every intermediate state when set.
+	TraceSink TraceSink
+	// StrictDecode makes DecodeInto and Decode report fields the target
+	// type does not know.
+	StrictDecode bool
+	// MemoryBase replaces the base file when set.
+	MemoryBase *MemoryFile
+	// MemoryLayers are sorted among the layer files by their Order.
+	MemoryLayers []MemoryLayer
 }
 
 func New(base string, layers []string) *Compose {
@@ -35,12 +92,39 @@ func NewWithFs(base string, layers []string, fs afero.Fs) *Compose {
 		Base:    base,
 		Layers:  layers,
 		fs:      &afero.Afero{Fs: fs},
-		marshal: marshalYAML,
+		marshal: MarshalYAML,
 		logOut:  io.Discard,
 	}
 }
 
-func marshalYAML(in any) ([]byte, error) {
+// NewWithOptions returns a Compose configured from opts.
+func NewWithOptions(opts Options) *Compose {
+	fs := opts.Fs
+	if fs == nil {
+		fs = afero.NewOsFs()
+	}
+
+	c := NewWithFs(opts.Base, opts.Layers, fs)
+	c.SetLayerDir(opts.LayerDir)
+	c.SetLayerDirs(opts.LayerDirs, opts.LayerFilter)
+	c.SetProfiles(opts.Profiles...)
+	c.SetLayerSelection(opts.LayerSelection)
+	c.SetTemplateVars(opts.TemplateVars)
+	c.SetTransformLogWriter(opts.TransformLogWriter)
+	c.SetMarshaller(opts.Marshaller)
+	c.SetAnnotate(opts.Annotate)
+	c.SetTraceSink(opts.TraceSink)
+	c.SetStrictDecode(opts.StrictDecode)
+	c.SetMemoryBase(opts.MemoryBase)
+	for _, layer := range opts.MemoryLayers {
+		c.AddMemoryLayer(layer)
+	}
+	return c
+}
+
+// MarshalYAML is the default MarshalFunc.  It renders YAML with two-space
+// indentation.
+func MarshalYAML(in any) ([]byte, error) {
 	var out bytes.Buffer
 	encoder := yaml.NewEncoder(&out)
 	encoder.SetIndent(yamlOutputIndentSpaces)
@@ -83,96 +167,341 @@ func (c *Compose) SetLayerDir(layerDir string) {
 	c.LayerDir = layerDir
 }
 
-func (c *Compose) Run() (string, error) {
-	for _, layer := range c.Layers {
-		if err := validateLayerName(layer); err != nil {
-			return "", err
-		}
+// SetLayerDirs makes every run discover the layers of dirs with
+// DiscoverLayers and filter, see LayerDirs.
+func (c *Compose) SetLayerDirs(dirs []string, filter DiscoverOptions) {
+	c.LayerDirs = dirs
+	c.layerFilter = filter
+}
+
+// SetMarshaller replaces the function Run uses to render the composed
+// document, e.g. with MarshalJSON.  A nil marshaller restores MarshalYAML.
+func (c *Compose) SetMarshaller(marshal MarshalFunc) {
+	if marshal == nil {
+		c.marshal = MarshalYAML
+		return
 	}
+	c.marshal = marshal
+}
+
+// SetAnnotate makes Run append a "# from <layer> operators[i]" comment to
+// every output value written by a layer.
+func (c *Compose) SetAnnotate(enabled bool) {
+	c.annotate = enabled
+}
+
+func (c *Compose) Run() (string, error) {
+	return c.RunContext(context.Background())
+}
+
+// RunContext composes like Run and gives up with ctx.Err() once ctx is done.
+// Cancellation is checked between layers, between operators and while list
+// operators walk their items.
+func (c *Compose) RunContext(ctx context.Context) (string, error) {
+	out, _, err := c.runWithProvenance(ctx)
+	return out, err
+}
+
+// RunWithProvenance composes like Run and also returns the origin of every
+// leaf value in the output.
+func (c *Compose) RunWithProvenance() (string, Provenance, error) {
+	return c.runWithProvenance(context.Background())
+}
 
-	sort.SliceStable(c.Layers, NewLayerComparator(c.Layers))
+func (c *Compose) runWithProvenance(ctx context.Context) (string, Provenance, error) {
+	result, err := c.Compose(ctx)
+	if err != nil {
+		return "", nil, err
+	}
 
-	in, err := c.fs.ReadFile(c.Base)
+	out, err := c.marshal(result.Document)
 	if err != nil {
-		return "", fmt.Errorf("failed to read base compose file: %s", err)
+		return "", nil, fmt.Errorf("failed to marshal compose file: %w", err)
+	}
+
+	return string(out), result.Provenance, nil
+}
+
+// composeRun is the state of one run: what it read, where its values came
+// from and who watches its steps.
+type composeRun struct {
+	*Compose
+	metadata   *Metadata
+	provenance *provenanceTracker
+	tracer     *tracer
+	observer   stepObserver
+}
+
+// newRun starts a run of c.  Set its observer to watch every step.
+func (c *Compose) newRun() *composeRun {
+	return &composeRun{
+		Compose:    c,
+		metadata:   &Metadata{},
+		provenance: newProvenanceTracker(),
+		tracer:     newTracer(c.traceSink),
+	}
+}
+
+// composeDocument applies every layer to the base and returns the composed
+// document.  It stops with ctx.Err() once ctx is done.
+func (c *composeRun) composeDocument(ctx context.Context) (*yaml.Node, error) {
+	layers, errs := c.layerStack()
+	if len(errs) > 0 {
+		return nil, errs[0]
 	}
 
-	var b map[string]any
-	err = yaml.Unmarshal(in, &b)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	doc, b, err := c.loadBase()
 	if err != nil {
-		return "", fmt.Errorf("failed to parse base compose file: %s", err)
+		return nil, err
 	}
 
-	layerDir := c.LayerDir
-	if layerDir == "" {
-		layerDir = c.Base + ".d"
+	c.provenance.claim(b, Origin{File: c.basePath(), Operator: -1})
+	if err := c.observeStep(composeStep{kind: stepBase, operatorIndex: -1, state: b}); err != nil {
+		return nil, err
 	}
 
-	for i, layer := range c.Layers {
-		layerPath := filepath.Join(layerDir, layer)
-		in, err := c.fs.ReadFile(layerPath)
-		if err != nil {
-			return "", fmt.Errorf("failed to read layer compose file %q: %s", layerPath, err)
+	for _, spec := range layers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		in, err = c.renderLayerTemplate(in, layer)
-		if err != nil {
-			return "", err
+		layer, layerPath := spec.name, spec.path
+		parsed, errs := c.loadLayer(spec)
+		if len(errs) > 0 {
+			return nil, withLayer(errs[0], layer, layerPath)
 		}
-
-		l, operators, err := parseLayer(in)
-		if err != nil {
-			return "", fmt.Errorf("failed to parse layer compose file %q: %s", layerPath, err)
+		if !parsed.activation.active(c.profiles) {
+			c.metadata.LayersSkipped = append(c.metadata.LayersSkipped, layer)
+			continue
 		}
+		if !parsed.when.match(c.whenScope(b)) {
+			c.metadata.LayersSkipped = append(c.metadata.LayersSkipped, layer)
+			step := composeStep{kind: stepLayer, layer: layer, layerPath: layerPath, operatorIndex: -1, state: b, skipped: true}
+			if err := c.observeStep(step); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		l := parsed.data
+		for opIndex, operator := range parsed.operators {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			if !operator.when.match(c.whenScope(b)) {
+				step := composeStep{kind: stepOperator, layer: layer, layerPath: layerPath, operatorIndex: opIndex, operator: &operator, state: b, skipped: true}
+				if err := c.observeStep(step); err != nil {
+					return nil, err
+				}
+				continue
+			}
 
-		for opIndex, operator := range operators {
-			l, b, err = c.applyLayerOperator(l, operator, b)
+			origin := c.operatorOrigin(layer, layerPath, opIndex, operator)
+			var directives map[string]mergeDirective
+			l, b, directives, err = c.applyLayerOperator(ctx, l, operator, b, origin)
 			if err != nil {
-				return "", fmt.Errorf("failed to apply layer operator operators[%d] (kind=%q) in layer[%d] %q: %w", opIndex, operator.kind, i, layer, err)
+				opErr := &OperatorError{
+					Layer:    layer,
+					File:     layerPath,
+					Operator: opIndex,
+					Kind:     operator.kind,
+					Err:      err,
+				}
+				if operator.node != nil {
+					opErr.Line, opErr.Column = operator.node.Line, operator.node.Column
+				}
+				return nil, withLayer(opErr, layer, layerPath)
 			}
+
+			step := composeStep{kind: stepOperator, layer: layer, layerPath: layerPath, operatorIndex: opIndex, operator: &operator, state: b, directives: directives}
+			if err := c.observeStep(step); err != nil {
+				return nil, err
+			}
+		}
+
+		step := composeStep{kind: stepLayer, layer: layer, layerPath: layerPath, operatorIndex: -1, state: b}
+		if err := c.observeStep(step); err != nil {
+			return nil, err
 		}
+		c.metadata.LayersApplied = append(c.metadata.LayersApplied, layer)
 	}
+	doc.Content[0] = b
+
+	return doc, nil
+}
+
+type composeStepKind int
+
+const (
+	stepBase composeStepKind = iota
+	stepOperator
+	stepLayer
+)
+
+// composeStep describes the composed state right after the base was loaded,
+// after one layer operator ran, or after a whole layer was applied.  A
+// skipped step is a layer or operator whose when clause did not hold; its
+// state is unchanged.
+type composeStep struct {
+	kind          composeStepKind
+	layer         string
+	layerPath     string
+	operatorIndex int
+	operator      *layerTransform
+	state         *yaml.Node
+	skipped       bool
+	// directives are the inline merge directives the operator applied, by
+	// path.
+	directives map[string]mergeDirective
+}
+
+// stepObserver is notified after every compose step.  Observers must not
+// modify the state.
+type stepObserver func(step composeStep) error
 
-	out, err := c.marshal(b)
+func (c *composeRun) observeStep(step composeStep) error {
+	if err := c.tracer.observe(step); err != nil {
+		return fmt.Errorf("failed to write trace step: %w", err)
+	}
+	if c.observer == nil {
+		return nil
+	}
+	return c.observer(step)
+}
+
+// operatorOrigin returns the origin recorded for values written by operator.
+func (c *Compose) operatorOrigin(layer string, layerPath string, opIndex int, operator layerTransform) Origin {
+	origin := Origin{Layer: layer, Operator: opIndex, Kind: operator.kind}
+	if operator.implicit {
+		origin.Operator = -1
+	}
+
+	switch operator.sourceFrom {
+	case transformSourceLayer:
+		origin.File = layerPath
+	case transformSourceFile:
+		origin.File = c.resolveSourcePath(operator.sourceFile)
+	}
+
+	return origin
+}
+
+// layerPath returns the path of a layer file: the layer directory joined
+// with the layer filename.
+func (c *Compose) layerPath(layer string) string {
+	return filepath.Join(c.layerDir(), layer)
+}
+
+// layerDir returns LayerDir, or "<base>.d" when unset.
+func (c *Compose) layerDir() string {
+	if c.LayerDir == "" {
+		return c.Base + ".d"
+	}
+	return c.LayerDir
+}
+
+// withLayer fills in the layer of every typed error in the chain of err
+// that does not know it yet.
+func withLayer(err error, layer string, layerPath string) error {
+	var parseErr *LayerParseError
+	if errors.As(err, &parseErr) && parseErr.Layer == "" {
+		parseErr.Layer, parseErr.File = layer, layerPath
+	}
+	var configErr *OperatorConfigError
+	if errors.As(err, &configErr) && configErr.Layer == "" {
+		configErr.Layer = layer
+	}
+	var sourceErr *SourceFileError
+	if errors.As(err, &sourceErr) && sourceErr.Layer == "" {
+		sourceErr.Layer = layer
+		var opErr *OperatorError
+		if errors.As(err, &opErr) {
+			sourceErr.Operator = opErr.Operator
+		}
+	}
+	return err
+}
+
+// parseBaseDocument parses the base file into a document node and returns it
+// together with its root mapping, which becomes the initial compose state.
+// Only the first document of a YAML stream is used.
+func parseBaseDocument(format string, in []byte) (*yaml.Node, *yaml.Node, error) {
+	docs, err := decodeDocuments(format, in)
+	if err != nil {
+		return nil, nil, err
+	}
+	return baseFromDocuments(docs)
+}
+
+// baseFromDocuments returns the first of the decoded base documents and its
+// root mapping, like parseBaseDocument.
+func baseFromDocuments(docs []*yaml.Node) (*yaml.Node, *yaml.Node, error) {
+	if len(docs) == 0 {
+		root := newMappingNode()
+		return newDocumentNode(root), root, nil
+	}
+
+	doc := docs[0]
+	root, err := documentMapping(doc)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal compose file: %s", err)
+		return nil, nil, err
 	}
+	doc.Content[0] = root
+	return doc, root, nil
+}
 
-	return string(out), nil
+// resolveSourcePath resolves a source.file path relative to the base file.
+func (c *Compose) resolveSourcePath(rawPath string) string {
+	if filepath.IsAbs(rawPath) {
+		return rawPath
+	}
+	return filepath.Clean(filepath.Join(filepath.Dir(c.Base), rawPath))
 }
 
-func (c *Compose) readSourceYAML(rawPath string) (any, error) {
-	resolvedPath := rawPath
-	if !filepath.IsAbs(rawPath) {
-		resolvedPath = filepath.Clean(filepath.Join(filepath.Dir(c.Base), rawPath))
+// readSourceFile reads a source.file in the format told by its extension.
+// Only the first document of a YAML stream is used.
+func (c *composeRun) readSourceFile(ctx context.Context, rawPath string) (*yaml.Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
+	resolvedPath := c.resolveSourcePath(rawPath)
+
 	in, err := c.fs.ReadFile(resolvedPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read transform source file %q: %w", resolvedPath, err)
+		return nil, &SourceFileError{File: resolvedPath, Op: "read", Err: err}
 	}
+	c.recordFileRead(resolvedPath)
 
-	var out any
-	if err := yaml.Unmarshal(in, &out); err != nil {
-		return nil, fmt.Errorf("failed to parse transform source file %q: %w", resolvedPath, err)
+	docs, err := decodeDocuments(fileFormat(resolvedPath), in)
+	if err != nil {
+		return nil, &SourceFileError{File: resolvedPath, Op: "parse", Line: syntaxErrorLine(err), Err: err}
+	}
+	if len(docs) == 0 {
+		return nil, nil
 	}
 
-	return out, nil
+	return docs[0].Content[0], nil
 }
 
-func (c *Compose) renderLayerTemplate(raw []byte, layer string) ([]byte, error) {
+func (c *Compose) renderLayerTemplate(raw []byte, layer string, layerPath string) ([]byte, error) {
 	if len(c.tplVars) == 0 {
 		return raw, nil
 	}
 
 	tpl, err := template.New(layer).Option("missingkey=error").Parse(string(raw))
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse layer template for %q: %w", layer, err)
+		return nil, &TemplateError{Layer: layer, File: layerPath, Op: "parse", Line: templateErrorLine(err), Err: err}
 	}
 
 	var out bytes.Buffer
 	if err := tpl.Execute(&out, c.tplVars); err != nil {
-		return nil, fmt.Errorf("failed to render layer template for %q: %w", layer, err)
+		return nil, &TemplateError{Layer: layer, File: layerPath, Op: "render", Line: templateErrorLine(err), Err: err}
 	}
 
 	return out.Bytes(), nil
@@ -1,10 +1,13 @@
 package compose
 
 import (
+	"context"
 	"errors"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func TestNew(t *testing.T) {
@@ -26,6 +29,10 @@ func TestPart(t *testing.T) {
 	prefix, name = part("layer.yaml")
 	require.Equal("layer.yaml", prefix)
 	require.Equal("", name)
+
+	prefix, name = part(filepath.Join("prod", "layer.yaml"))
+	require.Equal("layer.yaml", prefix)
+	require.Equal("", name)
 }
 
 func TestValidateLayerName(t *testing.T) {
@@ -49,8 +56,13 @@ func TestValidateLayerName(t *testing.T) {
 func TestMergeMapsWithNilBase(t *testing.T) {
 	require := require.New(t)
 
-	got := mergeMaps(nil, map[string]any{"service": "layer"})
-	require.Equal(map[string]any{"service": "layer"}, got)
+	layer := newMappingNode()
+	mappingSet(layer, "service", newStringNode("layer"))
+
+	got := mergeMaps(nil, layer)
+	value, err := decodeNodeValue(got)
+	require.NoError(err)
+	require.Equal(map[string]any{"service": "layer"}, value)
 }
 
 func TestRunReturnsMarshalError(t *testing.T) {
@@ -114,3 +126,137 @@ func TestParsePathSelectorSupportsQuotedStringValue(t *testing.T) {
 	require.Equal("name", key)
 	require.Equal("abc 123", value)
 }
+
+func TestListOperatorsStopWhenContextIsDone(t *testing.T) {
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	input := newSequenceNode([]*yaml.Node{newStringNode("a")})
+
+	_, err := applyListFilter(ctx, input, layerListFilter{})
+	require.ErrorIs(err, context.Canceled)
+	_, err = applyListExtract(ctx, input, layerListExtract{})
+	require.ErrorIs(err, context.Canceled)
+	_, err = applyListRemove(ctx, input, layerListRemove{})
+	require.ErrorIs(err, context.Canceled)
+}
+
+func TestWhenExpressions(t *testing.T) {
+	require := require.New(t)
+
+	var state yaml.Node
+	require.NoError(yaml.Unmarshal([]byte(`app:
+  db:
+    enabled: true
+    replicas: 3
+  hosts: [a, b]
+  servers:
+    - name: "api 1"
+      port: 8080
+  debug: false
+  flags:
+    upper: FALSE
+    title: True
+    zero: 0.0
+    hex: 0x0
+    ratio: 1.0
+    quoted: "FALSE"
+`), &state))
+	scope := whenScope{vars: map[string]string{"ENV": "prod", "REPLICAS": "3", "EMPTY": ""}, state: state.Content[0]}
+
+	cases := map[string]bool{
+		`vars.ENV == "prod" && state.app.db.enabled`:        true,
+		`vars.ENV == 'staging' || !state.app.db.enabled`:    false,
+		`vars.REPLICAS == state.app.db.replicas`:            true,
+		`state.app.db.replicas != 3`:                        false,
+		`state.app.servers[name="api 1"].port == 8080`:      true,
+		`state.app.hosts[1] == "b"`:                         true,
+		`state.app.debug || vars.EMPTY`:                     false,
+		`vars.MISSING == null && state.app.missing == null`: true,
+		`!(vars.ENV == "prod" && state.app.debug)`:          true,
+		`state.app.hosts && true`:                           true,
+		`state.app.flags.upper`:                             false,
+		`state.app.flags.title == true`:                     true,
+		`state.app.flags.upper == false`:                    true,
+		`state.app.flags.zero || state.app.flags.hex`:       false,
+		`state.app.flags.ratio == 1`:                        true,
+		`state.app.flags.quoted`:                            true,
+		`state.app.flags.quoted == false`:                   false,
+	}
+	for source, want := range cases {
+		expr, err := parseWhen(source)
+		require.NoError(err, source)
+		require.Equal(want, expr.match(scope), source)
+	}
+
+	expr, err := parseWhen("  ")
+	require.NoError(err)
+	require.Nil(expr)
+	require.True(expr.match(scope))
+
+	for source, message := range map[string]string{
+		`vars.ENV ==`:          "unexpected end of expression",
+		`(vars.ENV == "prod"`:  "expected ) at offset 19",
+		`env == "prod"`:        `unknown operand "env" at offset 0`,
+		`vars.ENV == "prod`:    "unterminated string at offset 12",
+		`vars.ENV "prod"`:      `unexpected "prod" at offset 9`,
+		`state.a..b`:           `invalid state path "a..b"`,
+		`vars.ENV = "prod"`:    `unexpected '=' at offset 9`,
+		`state.servers[name=a`: "unterminated [ at offset 13",
+	} {
+		_, err := parseWhen(source)
+		require.Error(err, source)
+		require.Contains(err.Error(), message, source)
+	}
+}
+
+func TestMergePathsResolveMostSpecificRule(t *testing.T) {
+	require := require.New(t)
+
+	strategy, err := buildLayerMergeStrategy(mergeMetadata{Paths: map[string]mergeMetadataStrategy{
+		"app.**":                   {List: "append"},
+		"app.services.**":          {List: "prepend"},
+		"app.services.*.ports":     {List: "union"},
+		"app.services.api.ports":   {List: "override"},
+		"app.backends[name=api].*": {Map: "override"},
+		"*.services.*.certs":       {List: "union"},
+		"*.db.logs":                {List: "union"},
+		"app.*.*.tags":             {List: "append"},
+		"*.services.*.tags":        {List: "union"},
+	}})
+	require.NoError(err)
+
+	cases := map[string]mergeStrategy{
+		"":                           defaultMergeStrategy,
+		"other":                      defaultMergeStrategy,
+		"app":                        {Map: mapMergeDeep, List: listMergeAppend},
+		"app.db.hosts":               {Map: mapMergeDeep, List: listMergeAppend},
+		"app.services":               {Map: mapMergeDeep, List: listMergePrepend},
+		"app.services.web.hosts":     {Map: mapMergeDeep, List: listMergePrepend},
+		"app.services.web.ports":     {Map: mapMergeDeep, List: listMergeUnion},
+		"app.services.api.ports":     {Map: mapMergeDeep, List: listMergeOverride},
+		"app.backends.name=api.tls":  {Map: mapMergeOverride, List: listMergeOverride},
+		"app.backends.name=web.tls":  {Map: mapMergeDeep, List: listMergeAppend},
+		"app.services.web.ports.0.x": {Map: mapMergeDeep, List: listMergePrepend},
+		// *.db.logs names more segments than app.**.
+		"app.db.logs": {Map: mapMergeDeep, List: listMergeUnion},
+		// Both name two segments; *.services.*.certs matches every segment.
+		"app.services.web.certs": {Map: mapMergeDeep, List: listMergeUnion},
+		// Both name two segments; app.*.*.tags names the first one.
+		"app.services.web.tags": {Map: mapMergeDeep, List: listMergeAppend},
+	}
+	for rawPath, want := range cases {
+		var path []string
+		if rawPath != "" {
+			path, err = parseDotPath(rawPath)
+			require.NoError(err)
+		}
+		require.Equal(want, strategy.resolve(path), rawPath)
+	}
+
+	_, err = buildLayerMergeStrategy(mergeMetadata{Paths: map[string]mergeMetadataStrategy{
+		"app.**.ports": {List: "append"},
+	}})
+	require.ErrorContains(err, `invalid merge.paths."app.**.ports": "**" must be the last segment`)
+}
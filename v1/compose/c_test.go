@@ -2,11 +2,19 @@ package compose_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"os"
 	"path"
 	"sort"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v3"
 
@@ -1431,6 +1439,33 @@ app:
 	require.Contains(err.Error(), "target.merge only supports defaults.list")
 }
 
+func TestComposeTransformListFilterReturnsErrorWhenTargetMergeSetsOnlyKey(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	layer := `operators:
+  - kind: list_filter
+    source:
+      from: state
+      path: app.backends
+    target:
+      path: app.backends
+      merge:
+        defaults:
+          key: name
+    list_filter:
+      include: ["prod-"]
+`
+	baseDir := writeBaseFile(t, fs, "base.yaml", "app:\n  backends: [prod-a]\n")
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", layer)
+
+	_, err := c.Run()
+	require.Error(err)
+	require.Contains(err.Error(), `invalid operators[0].target.merge: invalid merge.defaults: key is only supported with list strategy "merge_by"`)
+}
+
 func TestComposeTransformListFilterReturnsErrorForLegacyTargetList(t *testing.T) {
 	require := require.New(t)
 
@@ -2797,3 +2832,1947 @@ app: {}
 	require.Error(err)
 	require.Contains(err.Error(), "only one condition is supported")
 }
+
+func TestComposePreservesKeyOrderCommentsAndScalarStyle(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `# service settings
+zeta: 1
+# database
+app:
+  name: "quoted"
+  db:
+    host: base # primary host
+    pool: 10
+  motd: |
+    hello
+    world
+alpha: true
+`)
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", `app:
+  db:
+    host: prod
+    timeout: 5s
+  added: yes
+beta: 2
+`)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal(`# service settings
+zeta: 1
+# database
+app:
+  name: "quoted"
+  db:
+    host: prod # primary host
+    pool: 10
+    timeout: 5s
+  motd: |
+    hello
+    world
+  added: yes
+alpha: true
+beta: 2
+`, out)
+}
+
+func TestComposeExpandsAliasesAndMergeKeys(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `defaults: &defaults
+  retries: 3
+  timeout: 10
+app:
+  <<: *defaults
+  timeout: 20
+`)
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", `defaults:
+  retries: 5
+`)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.NotContains(out, "&defaults")
+	require.NotContains(out, "<<")
+
+	var got map[string]any
+	err = yaml.Unmarshal([]byte(out), &got)
+	require.NoError(err)
+	require.Equal(map[string]any{"retries": 5, "timeout": 10}, got["defaults"])
+	require.Equal(map[string]any{"retries": 3, "timeout": 20}, got["app"])
+}
+
+func TestComposeRunWithProvenanceRecordsOrigins(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml", "2-extract.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `app:
+  db:
+    host: base
+    pool: 10
+  backends:
+    - name: api
+    - name: web
+  backend-names: []
+`)
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", `app:
+  db:
+    host: prod
+`)
+	writeLayerFile(t, fs, baseDir, "2-extract.yaml", `operators:
+  - kind: list_extract
+    source:
+      from: state
+      path: app.backends
+    target:
+      path: app.backend-names
+    list_extract:
+      extract_path: name
+`)
+
+	_, provenance, err := c.RunWithProvenance()
+	require.NoError(err)
+
+	require.Equal(compose.Origin{File: "base.yaml", Line: 4, Operator: -1}, provenance["app.db.pool"])
+	require.Equal(compose.Origin{File: "base.yaml.d/1-layer.yaml", Line: 3, Layer: "1-layer.yaml", Operator: -1, Kind: "merge"}, provenance["app.db.host"])
+	require.Equal(compose.Origin{Layer: "2-extract.yaml", Operator: 0, Kind: "list_extract"}, provenance["app.backend-names[1]"])
+	require.Equal("base.yaml", provenance["app.backends[0].name"].File)
+	require.Equal("2-extract.yaml operators[0]", provenance["app.backend-names[0]"].String())
+}
+
+func TestComposeProvenanceFollowsPrependedListItems(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "ports: [5432]\n")
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", `operators:
+  - kind: merge
+    merge:
+      defaults:
+        list: prepend
+---
+ports: [5433]
+`)
+
+	_, provenance, err := c.RunWithProvenance()
+	require.NoError(err)
+	require.Equal("1-layer.yaml operators[0]", provenance["ports[0]"].String())
+	require.Equal("base.yaml", provenance["ports[1]"].String())
+}
+
+func TestComposeAnnotateAddsOriginComments(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `app:
+  host: base # primary
+  pool: 10
+  ports: [5432]
+`)
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", `operators:
+  - kind: merge
+    merge:
+      paths:
+        app.ports:
+          list: append
+---
+app:
+  host: prod
+  ports: [5433]
+`)
+	c.SetAnnotate(true)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal(`app:
+  host: prod # primary # from 1-layer.yaml operators[0]
+  pool: 10
+  ports:
+    - 5432
+    - 5433 # from 1-layer.yaml operators[0]
+`, out)
+}
+
+func TestComposeBlameReturnsPathHistory(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-prod.yaml", "2-noop.yaml", "3-ports.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `app:
+  db:
+    host: base
+    ports: [5432]
+`)
+	writeLayerFile(t, fs, baseDir, "1-prod.yaml", `app:
+  db:
+    host: prod
+`)
+	writeLayerFile(t, fs, baseDir, "2-noop.yaml", `other: true
+`)
+	writeLayerFile(t, fs, baseDir, "3-ports.yaml", `operators:
+  - kind: merge
+    merge:
+      paths:
+        app.db.ports:
+          list: append
+---
+app:
+  db:
+    host: prod
+    ports: [5433]
+`)
+
+	entries, err := c.Blame("app.db.host")
+	require.NoError(err)
+	require.Len(entries, 3)
+	require.Equal(compose.BlameEntry{
+		Operator: -1,
+		New:      "base",
+		NewSet:   true,
+		Origin:   compose.Origin{File: "base.yaml", Line: 3, Operator: -1},
+	}, entries[0])
+	require.Equal("1-prod.yaml", entries[1].Layer)
+	require.Equal(-1, entries[1].Operator)
+	require.Equal("merge", entries[1].Kind)
+	require.Equal("override", entries[1].Strategy)
+	require.Equal("base", entries[1].Old)
+	require.Equal("prod", entries[1].New)
+	require.Equal("3-ports.yaml", entries[2].Layer)
+	require.Equal(0, entries[2].Operator)
+	require.Equal("prod", entries[2].Old)
+
+	entries, err = c.Blame("app.db.ports")
+	require.NoError(err)
+	require.Len(entries, 2)
+	require.Equal("[5432]", entries[0].New)
+	require.Equal("append", entries[1].Strategy)
+	require.Equal("[5432, 5433]", entries[1].New)
+}
+
+func TestComposeBlameSupportsSelectorsAndUnsetPaths(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `backends:
+  - name: api
+    host: a
+`)
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", `backends:
+  - name: api
+    host: b
+`)
+
+	entries, err := c.Blame("backends[name=api].host")
+	require.NoError(err)
+	require.Len(entries, 2)
+	require.Equal("a", entries[0].New)
+	require.Equal("b", entries[1].New)
+
+	entries, err = c.Blame("missing.key")
+	require.NoError(err)
+	require.Len(entries, 1)
+	require.False(entries[0].NewSet)
+
+	_, err = c.Blame("a..b")
+	require.Error(err)
+	require.Contains(err.Error(), "invalid blame path")
+}
+
+func TestComposeBlameReportsInlineDirectiveStrategies(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-prod.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `app:
+  ports: [5432]
+  hosts: [a]
+  backends:
+    - name: api
+      port: 80
+  limits:
+    cpu: 1
+  tls:
+    cert: base
+`)
+	writeLayerFile(t, fs, baseDir, "1-prod.yaml", `app:
+  ports: !append [5433]
+  hosts: !prepend [b]
+  backends: !merge_by:name
+    - name: api
+      port: 8080
+  limits: !keep
+    cpu: 2
+    memory: 1Gi
+  tls: !override
+    key: prod
+`)
+
+	for path, want := range map[string]string{
+		"app.ports":         "append",
+		"app.hosts":         "prepend",
+		"app.backends":      "merge_by",
+		"app.limits":        "keep",
+		"app.limits.memory": "keep",
+		"app.tls":           "override",
+		"app.tls.key":       "override",
+	} {
+		entries, err := c.Blame(path)
+		require.NoError(err)
+		require.Len(entries, 2, path)
+		require.Equal(want, entries[1].Strategy, path)
+	}
+}
+
+func TestComposeBlameAttributesCollectionsToTheirNewestValue(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-prod.yaml", "2-ports.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `app:
+  db:
+    host: base
+    ports: [5432]
+`)
+	writeLayerFile(t, fs, baseDir, "1-prod.yaml", `app:
+  db:
+    host: prod
+`)
+	writeLayerFile(t, fs, baseDir, "2-ports.yaml", `operators:
+  - kind: merge
+    merge:
+      defaults:
+        list: append
+---
+app:
+  db:
+    ports: [5433]
+`)
+
+	entries, err := c.Blame("app.db")
+	require.NoError(err)
+	require.Len(entries, 3)
+	require.Equal(compose.Origin{File: "base.yaml", Line: 3, Operator: -1}, entries[0].Origin)
+	require.Equal(compose.Origin{File: "base.yaml.d/1-prod.yaml", Line: 3, Layer: "1-prod.yaml", Operator: -1, Kind: "merge"}, entries[1].Origin)
+	require.Equal(compose.Origin{File: "base.yaml.d/2-ports.yaml", Line: 9, Layer: "2-ports.yaml", Operator: 0, Kind: "merge"}, entries[2].Origin)
+
+	entries, err = c.Blame("app.db.ports")
+	require.NoError(err)
+	require.Len(entries, 2)
+	require.Equal(compose.Origin{File: "base.yaml", Line: 4, Operator: -1}, entries[0].Origin)
+	require.Equal("2-ports.yaml", entries[1].Origin.Layer)
+	require.Equal(9, entries[1].Origin.Line)
+}
+
+type recordingTraceSink struct {
+	steps []compose.TraceStep
+}
+
+func (s *recordingTraceSink) WriteStep(step compose.TraceStep) error {
+	s.steps = append(s.steps, step)
+	return nil
+}
+
+func TestComposeTraceSinkReceivesEveryStep(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-filter.yaml", "2-prod.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `hosts: [a1, b1]
+env: base
+`)
+	writeLayerFile(t, fs, baseDir, "1-filter.yaml", `operators:
+  - kind: list_filter
+    source:
+      from: state
+      path: hosts
+    list_filter:
+      include: ["^a"]
+`)
+	writeLayerFile(t, fs, baseDir, "2-prod.yaml", "env: prod\n")
+
+	sink := &recordingTraceSink{}
+	c.SetTraceSink(sink)
+	_, err := c.Run()
+	require.NoError(err)
+
+	names := make([]string, 0, len(sink.steps))
+	for _, step := range sink.steps {
+		names = append(names, step.Name)
+	}
+	require.Equal([]string{
+		"000-base",
+		"001-1-filter.yaml.op0-list_filter",
+		"002-1-filter.yaml.op1-merge",
+		"003-1-filter.yaml",
+		"004-2-prod.yaml.op0-merge",
+		"005-2-prod.yaml",
+	}, names)
+
+	require.Equal("hosts: [a1, b1]\nenv: base\n", string(sink.steps[0].State))
+	require.Empty(sink.steps[0].Diff)
+	require.Empty(sink.steps[1].Diff)
+	require.Equal("list_filter", sink.steps[1].Kind)
+	require.Equal(0, sink.steps[1].Operator)
+	require.Contains(sink.steps[2].Diff, "--- 001-1-filter.yaml.op0-list_filter\n+++ 002-1-filter.yaml.op1-merge\n")
+	require.Contains(sink.steps[2].Diff, "-hosts: [a1, b1]\n+hosts: [a1]\n")
+	require.Contains(sink.steps[4].Diff, "-env: base\n+env: prod\n")
+	require.Equal(-1, sink.steps[5].Operator)
+}
+
+type failingTraceSink struct{}
+
+func (failingTraceSink) WriteStep(compose.TraceStep) error {
+	return errors.New("disk full")
+}
+
+func TestComposeReturnsErrorWhenTraceSinkFails(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", nil)
+	writeFile(t, c.GetFilesystem(), "base.yaml", "a: 1\n")
+	c.SetTraceSink(failingTraceSink{})
+
+	_, err := c.Run()
+	require.Error(err)
+	require.Contains(err.Error(), "failed to write trace step: disk full")
+}
+
+func TestComposeReturnsOperatorConfigErrorWithPosition(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-filter.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "hosts: [a1]\n")
+	writeLayerFile(t, fs, baseDir, "1-filter.yaml", `operators:
+  - kind: list_filter
+    source:
+      from: state
+      path: hosts
+    list_filter:
+      include: ["^a", "("]
+---
+`)
+
+	_, err := c.Run()
+	require.Error(err)
+
+	var parseErr *compose.LayerParseError
+	require.ErrorAs(err, &parseErr)
+	require.Equal("1-filter.yaml", parseErr.Layer)
+	require.Equal(path.Join("base.yaml.d", "1-filter.yaml"), parseErr.File)
+	require.Equal(7, parseErr.Line)
+	require.Equal(23, parseErr.Column)
+
+	var configErr *compose.OperatorConfigError
+	require.ErrorAs(err, &configErr)
+	require.Equal("1-filter.yaml", configErr.Layer)
+	require.Equal(0, configErr.Operator)
+	require.Equal("operators[0].list_filter.include[1]", configErr.Field)
+	require.Equal(7, configErr.Line)
+	require.Equal(23, configErr.Column)
+	require.Contains(err.Error(), `at line 7, column 23: invalid operators[0].list_filter.include[1] "("`)
+}
+
+func TestComposeOperatorConfigErrorPointsAtEnclosingNodeForMissingField(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-extract.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "a: 1\n")
+	writeLayerFile(t, fs, baseDir, "1-extract.yaml", `operators:
+  - kind: merge
+  - kind: replace_values
+    source:
+      from: state
+      path: a
+---
+`)
+
+	_, err := c.Run()
+	var configErr *compose.OperatorConfigError
+	require.ErrorAs(err, &configErr)
+	require.Equal(1, configErr.Operator)
+	require.Equal("operators[1].replace_values.old", configErr.Field)
+	require.Equal(3, configErr.Line)
+	require.Equal(5, configErr.Column)
+}
+
+func TestComposeReturnsLayerParseErrorForInvalidYAML(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-bad.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "a: 1\n")
+	writeLayerFile(t, fs, baseDir, "1-bad.yaml", "a: 1\nb: [\n")
+
+	_, err := c.Run()
+	var parseErr *compose.LayerParseError
+	require.ErrorAs(err, &parseErr)
+	require.Equal("1-bad.yaml", parseErr.Layer)
+	require.Equal(2, parseErr.Line)
+
+	var configErr *compose.OperatorConfigError
+	require.False(errors.As(err, &configErr))
+}
+
+func TestComposeReturnsOperatorErrorWithPathError(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-filter.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "hosts: [a1]\n")
+	writeLayerFile(t, fs, baseDir, "1-filter.yaml", `operators:
+  - kind: merge
+  - kind: list_filter
+    source:
+      from: state
+      path: missing
+    list_filter:
+      include: ["^a"]
+---
+`)
+
+	_, err := c.Run()
+	var opErr *compose.OperatorError
+	require.ErrorAs(err, &opErr)
+	require.Equal("1-filter.yaml", opErr.Layer)
+	require.Equal(1, opErr.Operator)
+	require.Equal("list_filter", opErr.Kind)
+	require.Equal(3, opErr.Line)
+	require.Equal(5, opErr.Column)
+
+	var pathErr *compose.PathError
+	require.ErrorAs(err, &pathErr)
+	require.Equal("missing", pathErr.Path)
+	require.Contains(err.Error(), `in layer "1-filter.yaml" at line 3, column 5: source path "missing" not found`)
+}
+
+func TestComposeReturnsSourceFileError(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-filter.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "hosts: [a1]\n")
+	writeFile(t, fs, "hosts.yaml", "hosts: [\n")
+	writeLayerFile(t, fs, baseDir, "1-filter.yaml", `operators:
+  - kind: list_filter
+    source:
+      file: hosts.yaml
+      path: hosts
+    list_filter:
+      include: ["^a"]
+---
+`)
+
+	_, err := c.Run()
+	var sourceErr *compose.SourceFileError
+	require.ErrorAs(err, &sourceErr)
+	require.Equal("1-filter.yaml", sourceErr.Layer)
+	require.Equal(0, sourceErr.Operator)
+	require.Equal("hosts.yaml", sourceErr.File)
+	require.Equal("parse", sourceErr.Op)
+	require.Equal(1, sourceErr.Line)
+}
+
+func TestComposeReturnsTemplateError(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "a: 1\n")
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", "a: 1\nb: {{ .missing }}\n")
+	c.SetTemplateVars(map[string]string{"env": "prod"})
+
+	_, err := c.Run()
+	var tplErr *compose.TemplateError
+	require.ErrorAs(err, &tplErr)
+	require.Equal("1-layer.yaml", tplErr.Layer)
+	require.Equal("render", tplErr.Op)
+	require.Equal(2, tplErr.Line)
+}
+
+func TestComposeValidateReportsEveryProblem(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"2-ops.yaml", "bad-name.yaml", "1-tpl.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "hosts: [a1]\n")
+	writeLayerFile(t, fs, baseDir, "1-tpl.yaml", "env: {{ .missing }}\n")
+	writeLayerFile(t, fs, baseDir, "2-ops.yaml", `operators:
+  - kind: list_filter
+    source:
+      file: hosts.yaml
+      path: hosts
+  - kind: list_remove
+    source:
+      from: state
+      path: hosts
+    list_remove:
+      match_path: name
+      when: {is_empty: true}
+      remove: some
+---
+`)
+	c.SetTemplateVars(map[string]string{"env": "prod"})
+
+	err := c.Validate()
+	require.Error(err)
+
+	var validationErr *compose.ValidationError
+	require.ErrorAs(err, &validationErr)
+	require.Len(validationErr.Errors, 4)
+	require.Contains(validationErr.Errors[0].Error(), "invalid layer file name")
+
+	var tplErr *compose.TemplateError
+	require.ErrorAs(validationErr.Errors[1], &tplErr)
+	require.Equal("1-tpl.yaml", tplErr.Layer)
+
+	var sourceErr *compose.SourceFileError
+	require.ErrorAs(validationErr.Errors[2], &sourceErr)
+	require.Equal("2-ops.yaml", sourceErr.Layer)
+	require.Equal(0, sourceErr.Operator)
+	require.Equal("hosts.yaml", sourceErr.File)
+
+	var configErr *compose.OperatorConfigError
+	require.ErrorAs(validationErr.Errors[3], &configErr)
+	require.Equal(1, configErr.Operator)
+	require.Equal("operators[1].list_remove.remove", configErr.Field)
+	require.Equal(13, configErr.Line)
+
+	writeFile(t, fs, "hosts.yaml", "hosts: [a1]\n")
+	writeLayerFile(t, fs, baseDir, "2-ops.yaml", "hosts: [b1]\n")
+	c.Layers = []string{"1-tpl.yaml", "2-ops.yaml"}
+	c.SetTemplateVars(map[string]string{"missing": "prod"})
+	require.NoError(c.Validate())
+}
+
+func TestComposeMarshalJSONKeepsOrderAndPrecision(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-prod.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `zone: base
+id: 123456789012345678901234567890
+mask: 0x1F
+ratio: .5
+enabled: True
+1: one
+~: none
+html: <a&b>
+`)
+	writeLayerFile(t, fs, baseDir, "1-prod.yaml", "zone: prod\nadded: [1, null]\n")
+
+	c.SetMarshaller(compose.MarshalJSON)
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal(`{
+  "zone": "prod",
+  "id": 123456789012345678901234567890,
+  "mask": 31,
+  "ratio": 0.5,
+  "enabled": true,
+  "1": "one",
+  "null": "none",
+  "html": "<a&b>",
+  "added": [
+    1,
+    null
+  ]
+}
+`, out)
+
+	c.SetMarshaller(compose.MarshalJSONCompact)
+	out, err = c.Run()
+	require.NoError(err)
+	require.Equal(`{"zone":"prod","id":123456789012345678901234567890,"mask":31,"ratio":0.5,"enabled":true,"1":"one","null":"none","html":"<a&b>","added":[1,null]}`+"\n", out)
+}
+
+func TestComposeMarshalJSONRejectsUnrepresentableValues(t *testing.T) {
+	require := require.New(t)
+
+	_, err := compose.MarshalJSON(map[string]any{"a": map[string]any{"b": math.Inf(1)}})
+	require.Error(err)
+	require.Contains(err.Error(), `cannot convert "a.b" to JSON: .inf has no JSON representation`)
+
+	var doc yaml.Node
+	require.NoError(yaml.Unmarshal([]byte("1: a\n\"1\": b\n"), &doc))
+	_, err = compose.MarshalJSON(&doc)
+	require.Error(err)
+	require.Contains(err.Error(), `duplicate key "1"`)
+}
+
+func TestComposeFlattensEnvAndProperties(t *testing.T) {
+	require := require.New(t)
+
+	var doc yaml.Node
+	require.NoError(yaml.Unmarshal([]byte(`db:
+  host: prod
+  max-conns: 10
+  password: "p@ss word"
+hosts: [a1, b1]
+debug: ~
+`), &doc))
+
+	env, err := compose.NewEnvMarshaller(compose.FlattenOptions{Prefix: "APP"})
+	require.NoError(err)
+	out, err := env(&doc)
+	require.NoError(err)
+	require.Equal(`APP_DB_HOST=prod
+APP_DB_MAX_CONNS=10
+APP_DB_PASSWORD="p@ss word"
+APP_HOSTS_0=a1
+APP_HOSTS_1=b1
+APP_DEBUG=
+`, string(out))
+
+	properties, err := compose.NewPropertiesMarshaller(compose.FlattenOptions{Prefix: "app"})
+	require.NoError(err)
+	out, err = properties(&doc)
+	require.NoError(err)
+	require.Equal(`app.db.host=prod
+app.db.max-conns=10
+app.db.password=p@ss word
+app.hosts[0]=a1
+app.hosts[1]=b1
+app.debug=
+`, string(out))
+
+	env, err = compose.NewEnvMarshaller(compose.FlattenOptions{
+		Separator: "__",
+		KeyCase:   compose.KeyCaseLower,
+		ListIndex: compose.ListIndexJSON,
+		Quote:     compose.QuoteSingle,
+	})
+	require.NoError(err)
+	out, err = env(&doc)
+	require.NoError(err)
+	require.Contains(string(out), "db__max_conns='10'\n")
+	require.Contains(string(out), `hosts='["a1","b1"]'`)
+}
+
+func TestComposeFlattenEscapesPropertiesValues(t *testing.T) {
+	require := require.New(t)
+
+	properties, err := compose.NewPropertiesMarshaller(compose.FlattenOptions{})
+	require.NoError(err)
+	out, err := properties(map[string]any{"a key": "  x=1\nnaïve #1"})
+	require.NoError(err)
+	require.Equal(`a\ key=\ \ x\=1\nna\u00EFve \#1`+"\n", string(out))
+}
+
+func TestComposeFlattenReportsUnrepresentableValues(t *testing.T) {
+	require := require.New(t)
+
+	var doc yaml.Node
+	require.NoError(yaml.Unmarshal([]byte("app:\n  tags: []\n  motd: \"a\\nb\"\n"), &doc))
+
+	env, err := compose.NewEnvMarshaller(compose.FlattenOptions{})
+	require.NoError(err)
+	_, err = env(&doc)
+	require.Error(err)
+	require.Contains(err.Error(), `cannot flatten "app.tags": empty list has no flat representation`)
+
+	env, err = compose.NewEnvMarshaller(compose.FlattenOptions{Quote: compose.QuoteNone})
+	require.NoError(err)
+	_, err = env(map[string]any{"motd": "a\nb"})
+	require.Error(err)
+	require.Contains(err.Error(), `cannot flatten "motd": value with line breaks needs quoting`)
+
+	env, err = compose.NewEnvMarshaller(compose.FlattenOptions{Unrepresentable: compose.UnrepresentableJSON})
+	require.NoError(err)
+	out, err := env(&doc)
+	require.NoError(err)
+	require.Equal("APP_TAGS=\"[]\"\nAPP_MOTD=\"a\\nb\"\n", string(out))
+
+	_, err = env(map[string]any{"a": map[string]any{"b": 1}, "a_b": 2})
+	require.Error(err)
+	require.Contains(err.Error(), `key A_B is also produced by "a.b"`)
+
+	var hosts yaml.Node
+	require.NoError(yaml.Unmarshal([]byte("app:\n  db-host: a\n  db_host: b\n"), &hosts))
+	_, err = env(&hosts)
+	require.Error(err)
+	require.Contains(err.Error(), `cannot flatten "app.db_host": key APP_DB_HOST is also produced by "app.db-host"`)
+
+	_, err = compose.NewEnvMarshaller(compose.FlattenOptions{KeyCase: "title"})
+	require.Error(err)
+	require.Contains(err.Error(), `invalid key case "title"`)
+}
+
+func TestComposeAcceptsJSONAndTOMLFiles(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.json", []string{"1-defaults.toml", "2-inventory.json"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.json", `{
+  "service": {"name": "api", "port": 8080},
+  "id": 123456789012345678901234567890,
+  "hosts": []
+}`)
+	writeLayerFile(t, fs, baseDir, "1-defaults.toml", `
+[service]
+timeout = 30
+port = 9090
+
+[[service.backends]]
+name = "b1"
+weight = 1.5
+`)
+	writeFile(t, fs, "hosts.toml", "hosts = [\"a1\", \"b1\", \"a2\"]\n")
+	writeLayerFile(t, fs, baseDir, "2-inventory.json", `{
+  "operators": [
+    {"kind": "list_filter", "source": {"file": "hosts.toml", "path": "hosts"}, "list_filter": {"include": ["^a"]}},
+    {"kind": "merge", "merge": {"paths": {"hosts": {"list": "append"}}}}
+  ],
+  "region": "eu"
+}`)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal(`service:
+  name: api
+  port: 9090
+  timeout: 30
+  backends:
+    - name: b1
+      weight: 1.5
+id: 123456789012345678901234567890
+hosts:
+  - a1
+  - a2
+region: eu
+`, out)
+}
+
+func TestComposeReportsJSONLayerErrorsWithPosition(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-bad.json", "2-ops.json"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "a: 1\n")
+	writeLayerFile(t, fs, baseDir, "1-bad.json", "{\n  \"a\": 1,\n  \"b\": \n}\n")
+	writeLayerFile(t, fs, baseDir, "2-ops.json", `{
+  "operators": [
+    {"kind": "list_filter", "source": {"from": "nowhere", "path": "a"}}
+  ]
+}`)
+
+	err := c.Validate()
+	var validationErr *compose.ValidationError
+	require.ErrorAs(err, &validationErr)
+	require.Len(validationErr.Errors, 2)
+
+	var parseErr *compose.LayerParseError
+	require.ErrorAs(validationErr.Errors[0], &parseErr)
+	require.Equal("1-bad.json", parseErr.Layer)
+	require.Equal(4, parseErr.Line)
+
+	var configErr *compose.OperatorConfigError
+	require.ErrorAs(validationErr.Errors[1], &configErr)
+	require.Equal("operators[0].source.from", configErr.Field)
+	require.Equal(3, configErr.Line)
+	require.Equal(48, configErr.Column)
+}
+
+// cancelingTraceSink cancels a compose run when it receives its first step.
+type cancelingTraceSink struct {
+	recordingTraceSink
+	cancel context.CancelFunc
+}
+
+func (s *cancelingTraceSink) WriteStep(step compose.TraceStep) error {
+	s.cancel()
+	return s.recordingTraceSink.WriteStep(step)
+}
+
+func TestComposeRunContextStopsWhenContextIsDone(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "service: base\n")
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", "service: layer\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &cancelingTraceSink{cancel: cancel}
+	c.SetTraceSink(sink)
+	_, err := c.RunContext(ctx)
+	require.ErrorIs(err, context.Canceled)
+	require.Len(sink.steps, 1)
+	require.Equal("000-base", sink.steps[0].Name)
+
+	c.SetTraceSink(nil)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = c.RunContext(ctx)
+	require.ErrorIs(err, context.DeadlineExceeded)
+
+	out, err := c.RunContext(context.Background())
+	require.NoError(err)
+	require.Equal("service: layer\n", out)
+}
+
+func TestComposeReturnsResultWithMetadata(t *testing.T) {
+	require := require.New(t)
+
+	fs := afero.NewMemMapFs()
+	c := compose.NewWithOptions(compose.Options{
+		Base:         "base.yaml",
+		Layers:       []string{"2-extract.yaml", "1-env.yaml"},
+		Fs:           fs,
+		TemplateVars: map[string]string{"ENV": "prod"},
+	})
+	afs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, afs, "base.yaml", `app:
+  env: dev
+  backends:
+    - name: worker
+`)
+	writeLayerFile(t, afs, baseDir, "1-env.yaml", "app:\n  env: {{ .ENV }}\n")
+	writeLayerFile(t, afs, baseDir, "2-extract.yaml", `operators:
+  - kind: list_extract
+    source:
+      file: source.yaml
+      path: inventory.backends
+    target:
+      path: app.backends[name=api].names
+      ignore_not_found: true
+    list_extract:
+      extract_path: name
+---
+app:
+  backends:
+    - name: worker
+`)
+	writeFile(t, afs, "source.yaml", "inventory:\n  backends:\n    - name: prod-a\n")
+
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{"1-env.yaml", "2-extract.yaml"}, result.LayersApplied)
+	require.Equal([]string{"base.yaml", "base.yaml.d/1-env.yaml", "base.yaml.d/2-extract.yaml", "source.yaml"}, result.FilesRead)
+	require.Len(result.Warnings, 1)
+	require.Equal("2-extract.yaml", result.Warnings[0].Layer)
+	require.Equal(0, result.Warnings[0].Operator)
+	require.Contains(result.Warnings[0].String(), "ignore_not_found discarded the output")
+	require.Contains(result.Warnings[0].String(), "selector [name=api]")
+	require.Equal("base.yaml.d/1-env.yaml", result.Provenance["app.env"].File)
+
+	got, err := result.Map()
+	require.NoError(err)
+	require.Equal(map[string]any{
+		"app": map[string]any{
+			"env":      "prod",
+			"backends": []any{map[string]any{"name": "worker"}},
+		},
+	}, got)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Compose(ctx)
+	require.ErrorIs(err, context.Canceled)
+}
+
+type decodeTestConfig struct {
+	App struct {
+		Name string `yaml:"name"`
+		DB   struct {
+			Host  string `yaml:"host"`
+			Ports []int  `yaml:"ports"`
+		} `yaml:"db"`
+	} `yaml:"app"`
+}
+
+func TestComposeDecodesIntoStruct(t *testing.T) {
+	require := require.New(t)
+
+	fs := afero.NewMemMapFs()
+	afs := &afero.Afero{Fs: fs}
+	baseDir := writeBaseFile(t, afs, "base.yaml", `app:
+  name: api
+  db:
+    host: localhost
+    ports: [5432]
+`)
+	writeLayerFile(t, afs, baseDir, "1-prod.yaml", "app:\n  db:\n    host: prod\n")
+
+	cfg, err := compose.Decode[decodeTestConfig](context.Background(), compose.Options{
+		Base:         "base.yaml",
+		Layers:       []string{"1-prod.yaml"},
+		Fs:           fs,
+		StrictDecode: true,
+	})
+	require.NoError(err)
+	require.Equal("api", cfg.App.Name)
+	require.Equal("prod", cfg.App.DB.Host)
+	require.Equal([]int{5432}, cfg.App.DB.Ports)
+}
+
+func TestComposeDecodeReportsComposedPathAndLayer(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-prod.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `app:
+  name: api
+  db:
+    host: localhost
+    ports: [5432, 5433]
+`)
+	writeLayerFile(t, fs, baseDir, "1-prod.yaml", `operators:
+  - kind: merge
+    merge:
+      paths:
+        app.db.ports:
+          list: append
+---
+app:
+  db:
+    ports: [abc]
+    pool: 10
+`)
+
+	var cfg decodeTestConfig
+	err := c.DecodeInto(context.Background(), &cfg)
+	require.Error(err)
+	var decodeErr *compose.DecodeError
+	require.ErrorAs(err, &decodeErr)
+	require.Equal("app.db.ports[2]", decodeErr.Path)
+	require.Equal("1-prod.yaml", decodeErr.Origin.Layer)
+	require.Equal(0, decodeErr.Origin.Operator)
+	require.Contains(err.Error(), `cannot decode "app.db.ports[2]" set by 1-prod.yaml operators[0]: cannot unmarshal !!str`)
+	require.NotContains(err.Error(), "pool")
+
+	c.SetStrictDecode(true)
+	err = c.DecodeInto(context.Background(), &cfg)
+	require.Error(err)
+	var validationErr *compose.ValidationError
+	require.ErrorAs(err, &validationErr)
+	require.Len(validationErr.Errors, 2)
+	require.Contains(err.Error(), `cannot decode "app.db.pool" set by 1-prod.yaml operators[0]: field pool not found in type`)
+
+	c = compose.NewMock("base.yaml", nil)
+	writeBaseFile(t, c.GetFilesystem(), "base.yaml", "app:\n  db: localhost\n")
+	err = c.DecodeInto(context.Background(), &cfg)
+	require.ErrorAs(err, &decodeErr)
+	require.Equal("app.db", decodeErr.Path)
+	require.Contains(err.Error(), `cannot decode "app.db" set by base.yaml: cannot unmarshal !!str`)
+}
+
+func TestComposeReadsFromIOFS(t *testing.T) {
+	require := require.New(t)
+
+	fsys := fstest.MapFS{
+		"config/base.yaml":                {Data: []byte("service: base\nhosts: []\n")},
+		"config/base.yaml.d/2-prod.yaml":  {Data: []byte("operators:\n  - kind: list_extract\n    source:\n      file: hosts.yaml\n      path: hosts\n    target:\n      path: hosts\n    list_extract:\n      extract_path: name\n---\nservice: prod\n")},
+		"config/base.yaml.d/1-env.json":   {Data: []byte(`{"env": "prod"}`)},
+		"config/base.yaml.d/README.md":    {Data: []byte("not a layer\n")},
+		"config/base.yaml.d/3-dir.yaml/x": {Data: []byte("not a layer\n")},
+		"config/hosts.yaml":               {Data: []byte("hosts:\n  - name: a1\n")},
+	}
+
+	c, err := compose.NewFromFS(fsys, "config/base.yaml", "")
+	require.NoError(err)
+
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{"1-env.json", "2-prod.yaml"}, result.LayersApplied)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal("service: prod\nhosts:\n  - a1\nenv: prod\n", out)
+
+	_, err = compose.NewFromFS(fsys, "config/base.yaml", "config/missing.d")
+	require.Error(err)
+	require.Contains(err.Error(), `failed to read layer directory "config/missing.d"`)
+}
+
+func TestComposeFromIOFSDiscoversProfilesEveryRun(t *testing.T) {
+	require := require.New(t)
+
+	fsys := fstest.MapFS{
+		"base.yaml":                  {Data: []byte("service: base\n")},
+		"base.yaml.d/1-app.yaml":     {Data: []byte("service: app\n")},
+		"base.yaml.d/prod/2-db.yaml": {Data: []byte("db: prod\n")},
+	}
+
+	c, err := compose.NewFromFS(fsys, "base.yaml", "")
+	require.NoError(err)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal("service: app\n", out)
+
+	c.SetProfiles("prod")
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{"1-app.yaml", "prod/2-db.yaml"}, result.LayersApplied)
+
+	out, err = c.Run()
+	require.NoError(err)
+	require.Equal("service: app\ndb: prod\n", out)
+}
+
+func TestDiscoverLayers(t *testing.T) {
+	require := require.New(t)
+
+	fs := afero.NewMemMapFs()
+	afs := &afero.Afero{Fs: fs}
+	for _, name := range []string{
+		"10-z.yaml", "2-b.yml", "1-a.yaml", "3-c.txt", "4-d.json", "5-e.toml",
+		".6-hidden.yaml", "7-backup.yaml~", "#8-autosave.yaml#", "9-dir.yaml/x.yaml",
+	} {
+		writeFile(t, afs, path.Join("/layers", name), "a: 1\n")
+	}
+
+	layers, err := compose.DiscoverLayers(fs, "/layers", compose.DiscoverOptions{})
+	require.NoError(err)
+	require.Equal([]string{"1-a.yaml", "2-b.yml", "4-d.json", "5-e.toml", "10-z.yaml"}, layers)
+
+	layers, err = compose.DiscoverLayers(fs, "/layers", compose.DiscoverOptions{
+		Include: []string{"*.yaml", "*.yml"},
+		Exclude: []string{"1-*"},
+	})
+	require.NoError(err)
+	require.Equal([]string{"2-b.yml", "10-z.yaml"}, layers)
+
+	for _, name := range []string{"prod/1-prod.yaml", "prod/10-z.yaml", "prod/eu/3-eu.yaml", "eu/2-eu.yaml", "staging/1-staging.yaml"} {
+		writeFile(t, afs, path.Join("/layers", name), "a: 1\n")
+	}
+	layers, err = compose.DiscoverLayers(fs, "/layers", compose.DiscoverOptions{Profiles: []string{"prod", "eu"}})
+	require.NoError(err)
+	require.Equal([]string{
+		"1-a.yaml", "prod/1-prod.yaml", "2-b.yml", "eu/2-eu.yaml", "prod/eu/3-eu.yaml",
+		"4-d.json", "5-e.toml", "10-z.yaml", "prod/10-z.yaml",
+	}, layers)
+
+	layers, err = compose.DiscoverLayers(fs, "/layers", compose.DiscoverOptions{
+		Profiles: []string{"prod", "eu"},
+		Include:  []string{"1*"},
+		Exclude:  []string{"prod/*"},
+	})
+	require.NoError(err)
+	require.Equal([]string{"1-a.yaml", "10-z.yaml"}, layers)
+
+	_, err = compose.DiscoverLayers(fs, "/layers", compose.DiscoverOptions{Include: []string{"["}})
+	require.Error(err)
+	require.Contains(err.Error(), `invalid layer glob "["`)
+
+	_, err = compose.DiscoverLayers(fs, "/missing", compose.DiscoverOptions{})
+	require.Error(err)
+	require.Contains(err.Error(), `failed to read layer directory "/missing"`)
+}
+
+func TestComposeMixesMemoryAndFileLayers(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("config/base.yaml", []string{"1-defaults.yaml", "3-final.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "config/base.yaml", "unused: true\n")
+	writeLayerFile(t, fs, baseDir, "1-defaults.yaml", "tenant: default\nlimits:\n  cpu: 1\n")
+	writeLayerFile(t, fs, baseDir, "3-final.yaml", "frozen: true\n")
+
+	c.SetMemoryBase(&compose.MemoryFile{Name: "base", Value: map[string]any{"service": "api"}})
+	c.AddMemoryLayer(compose.MemoryLayer{Order: 2, MemoryFile: compose.MemoryFile{
+		Name:   "tenant-acme",
+		Format: "json",
+		Data:   []byte(`{"tenant": "acme", "limits": {"memory": "1Gi"}}`),
+	}})
+	c.AddMemoryLayer(compose.MemoryLayer{Order: 2, MemoryFile: compose.MemoryFile{
+		Name: "tenant-acme-overrides",
+		Value: map[string]any{
+			"operators": []any{map[string]any{"kind": "merge", "merge": map[string]any{"defaults": map[string]any{"map": "override"}}}},
+			"limits":    map[string]any{"cpu": 4},
+		},
+	}})
+
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{"1-defaults.yaml", "tenant-acme", "tenant-acme-overrides", "3-final.yaml"}, result.LayersApplied)
+	require.Equal([]string{"config/base.yaml.d/1-defaults.yaml", "config/base.yaml.d/3-final.yaml"}, result.FilesRead)
+	require.Equal("memory:base", result.Provenance["service"].File)
+	require.Equal("tenant-acme", result.Provenance["tenant"].Layer)
+	require.Equal("memory:tenant-acme", result.Provenance["tenant"].File)
+
+	out, err := compose.MarshalYAML(result.Document)
+	require.NoError(err)
+	require.Equal("service: api\ntenant: acme\nlimits:\n  cpu: 4\nfrozen: true\n", string(out))
+
+	c.AddMemoryLayer(compose.MemoryLayer{Order: 4, MemoryFile: compose.MemoryFile{
+		Name: "tenant-broken",
+		Data: []byte("operators:\n  - kind: nope\n---\na: 1\n"),
+	}})
+	_, err = c.Run()
+	require.Error(err)
+	var parseErr *compose.LayerParseError
+	require.ErrorAs(err, &parseErr)
+	require.Equal("tenant-broken", parseErr.Layer)
+	require.Equal("memory:tenant-broken", parseErr.File)
+	require.Equal(2, parseErr.Line)
+}
+
+func TestComposeRunsConcurrently(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("config/base.yaml", []string{"1-prod.yaml"})
+	fs := c.GetFilesystem()
+	baseDir := writeBaseFile(t, fs, "config/base.yaml", "service: base\n")
+	writeLayerFile(t, fs, baseDir, "1-prod.yaml", "service: prod\n")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			result, err := c.Compose(context.Background())
+			if err == nil && (len(result.LayersApplied) != 1 || len(result.FilesRead) != 2 || result.Provenance["service"].Layer != "1-prod.yaml") {
+				err = fmt.Errorf("unexpected result: %+v %+v", result.Metadata, result.Provenance)
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			entries, err := c.Blame("service")
+			if err == nil && len(entries) != 2 {
+				err = fmt.Errorf("unexpected blame: %+v", entries)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(err)
+	}
+}
+
+func TestComposeRejectsNegativeMemoryLayerOrder(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-defaults.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "owner: base\n")
+	writeLayerFile(t, fs, baseDir, "1-defaults.yaml", "owner: defaults\n")
+	c.AddMemoryLayer(compose.MemoryLayer{Order: -1, MemoryFile: compose.MemoryFile{
+		Name:  "early",
+		Value: map[string]any{"owner": "early"},
+	}})
+
+	_, err := c.Run()
+	require.Error(err)
+	require.Contains(err.Error(), `invalid memory layer "early": order must not be negative, got -1`)
+}
+
+func TestComposeOrdersMemoryLayersWithSlashesInTheirName(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"2-file.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "owner: base\n")
+	writeLayerFile(t, fs, baseDir, "2-file.yaml", "owner: file\n")
+	c.AddMemoryLayer(compose.MemoryLayer{Order: 1, MemoryFile: compose.MemoryFile{
+		Name:  "tenants/acme",
+		Value: map[string]any{"owner": "acme"},
+	}})
+	c.AddMemoryLayer(compose.MemoryLayer{Order: 10, MemoryFile: compose.MemoryFile{
+		Name:  "tenants/late",
+		Value: map[string]any{"late": true},
+	}})
+
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{"tenants/acme", "2-file.yaml", "tenants/late"}, result.LayersApplied)
+	require.Equal("2-file.yaml", result.Provenance["owner"].Layer)
+}
+
+func TestComposeStacksLayerDirs(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", nil)
+	fs := c.GetFilesystem()
+
+	writeBaseFile(t, fs, "base.yaml", "owner: base\n")
+	writeLayerFile(t, fs, "defaults.d", "1-platform.yaml", "owner: platform\nlog: info\n")
+	writeLayerFile(t, fs, "defaults.d", "3-platform-final.yaml", "final: platform\n")
+	writeLayerFile(t, fs, "service.d", "1-app.yaml", "owner: app\n")
+	writeLayerFile(t, fs, "service.d", "2-app.yaml", "log: debug\n")
+	c.SetLayerDirs([]string{"defaults.d", "service.d"}, compose.DiscoverOptions{})
+
+	sink := &recordingTraceSink{}
+	c.SetTraceSink(sink)
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{
+		"defaults.d/1-platform.yaml",
+		"service.d/1-app.yaml",
+		"service.d/2-app.yaml",
+		"defaults.d/3-platform-final.yaml",
+	}, result.LayersApplied)
+	require.Equal("service.d/1-app.yaml", result.Provenance["owner"].Layer)
+	require.Equal("001-defaults.d_1-platform.yaml.op0-merge", sink.steps[1].Name)
+
+	out, err := compose.MarshalYAML(result.Document)
+	require.NoError(err)
+	require.Equal("owner: app\nlog: debug\nfinal: platform\n", string(out))
+
+	writeLayerFile(t, fs, "service.d", "2-app.yaml", "operators:\n  - kind: nope\n---\nlog: debug\n")
+	_, err = c.Run()
+	require.Error(err)
+	require.Contains(err.Error(), `failed to parse layer compose file "service.d/2-app.yaml" at line 2`)
+
+	c.SetLayerDirs([]string{"defaults.d", "missing.d"}, compose.DiscoverOptions{})
+	_, err = c.Run()
+	require.Error(err)
+	require.Contains(err.Error(), `failed to read layer directory "missing.d"`)
+}
+
+func TestComposeAppliesLayersByProfileAndTag(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-common.yaml", "2-prod.yaml", "3-staging.json", "4-debug.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "replicas: 1\n")
+	writeLayerFile(t, fs, baseDir, "1-common.yaml", "log: info\n")
+	writeLayerFile(t, fs, baseDir, "2-prod.yaml", `profiles: [prod]
+operators:
+  - kind: merge
+---
+replicas: 3
+`)
+	writeLayerFile(t, fs, baseDir, "3-staging.json", `{
+  "profiles": ["staging"],
+  "operators": [{"kind": "merge"}],
+  "replicas": 2
+}`)
+	writeLayerFile(t, fs, baseDir, "4-debug.yaml", "tags: [debug]\n---\nlog: debug\n")
+
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{"1-common.yaml"}, result.LayersApplied)
+	require.Equal([]string{"2-prod.yaml", "3-staging.json", "4-debug.yaml"}, result.LayersSkipped)
+	out, err := result.Map()
+	require.NoError(err)
+	require.Equal(map[string]any{"replicas": 1, "log": "info"}, out)
+
+	c.SetProfiles("staging", "debug")
+	result, err = c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{"1-common.yaml", "3-staging.json", "4-debug.yaml"}, result.LayersApplied)
+	out, err = result.Map()
+	require.NoError(err)
+	require.Equal(map[string]any{"replicas": 2, "log": "debug"}, out)
+}
+
+func TestComposeSkipsLayersAndOperatorsByWhen(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-db.yaml", "2-prod.yaml", "3-staging.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "app:\n  db:\n    enabled: false\n  hosts: [a1, b1]\n")
+	writeLayerFile(t, fs, baseDir, "1-db.yaml", `operators:
+  - kind: list_filter
+    when: state.app.db.enabled
+    source:
+      from: state
+      path: app.hosts
+    list_filter:
+      include: ["^a"]
+  - kind: merge
+    when: vars.ENV == "prod" && !state.app.db.enabled
+---
+app:
+  db:
+    enabled: true
+`)
+	writeLayerFile(t, fs, baseDir, "2-prod.yaml", `when: vars.ENV == "prod" && state.app.db.enabled
+---
+app:
+  replicas: 3
+`)
+	writeLayerFile(t, fs, baseDir, "3-staging.yaml", "when: vars.ENV == \"staging\"\n---\napp:\n  replicas: 2\n")
+
+	sink := &recordingTraceSink{}
+	c.SetTraceSink(sink)
+	c.SetTemplateVars(map[string]string{"ENV": "prod"})
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{"1-db.yaml", "2-prod.yaml"}, result.LayersApplied)
+	require.Equal([]string{"3-staging.yaml"}, result.LayersSkipped)
+	out, err := result.Map()
+	require.NoError(err)
+	require.Equal(map[string]any{"app": map[string]any{
+		"db":       map[string]any{"enabled": true},
+		"hosts":    []any{"a1", "b1"},
+		"replicas": 3,
+	}}, out)
+
+	names := make([]string, 0, len(sink.steps))
+	for _, step := range sink.steps {
+		names = append(names, step.Name)
+	}
+	require.Equal([]string{
+		"000-base",
+		"001-1-db.yaml.op0-list_filter.skipped",
+		"002-1-db.yaml.op1-merge",
+		"003-1-db.yaml",
+		"004-2-prod.yaml.op0-merge",
+		"005-2-prod.yaml",
+		"006-3-staging.yaml.skipped",
+	}, names)
+	require.True(sink.steps[1].Skipped)
+	require.Empty(sink.steps[1].Diff)
+	require.False(sink.steps[2].Skipped)
+}
+
+func TestComposeReportsInvalidWhen(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-op.yaml", "2-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", "a: 1\n")
+	writeLayerFile(t, fs, baseDir, "1-op.yaml", `operators:
+  - kind: merge
+    when: vars.ENV = "prod"
+---
+a: 2
+`)
+	writeLayerFile(t, fs, baseDir, "2-layer.yaml", "when: (vars.ENV\n---\na: 3\n")
+
+	err := c.Validate()
+	require.Error(err)
+	var validationErr *compose.ValidationError
+	require.ErrorAs(err, &validationErr)
+	require.Len(validationErr.Errors, 2)
+
+	var configErr *compose.OperatorConfigError
+	require.ErrorAs(validationErr.Errors[0], &configErr)
+	require.Equal("operators[0].when", configErr.Field)
+	require.Equal(3, configErr.Line)
+	require.Contains(configErr.Error(), `invalid operators[0].when "vars.ENV = \"prod\"": unexpected '=' at offset 9`)
+
+	var parseErr *compose.LayerParseError
+	require.ErrorAs(validationErr.Errors[1], &parseErr)
+	require.Equal("2-layer.yaml", parseErr.Layer)
+	require.Equal(1, parseErr.Line)
+	require.Contains(parseErr.Error(), `invalid when "(vars.ENV": expected ) at offset 9`)
+}
+
+func TestComposeSelectsLayers(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", nil)
+	fs := c.GetFilesystem()
+
+	writeBaseFile(t, fs, "base.yaml", "steps: []\n")
+	writeLayerFile(t, fs, "defaults.d", "1-platform.yaml", "platform: true\n")
+	writeLayerFile(t, fs, "defaults.d", "3-platform-final.yaml", "final: true\n")
+	writeLayerFile(t, fs, "service.d", "2-app.yaml", "app: true\n")
+	writeLayerFile(t, fs, "service.d", "prod/2-app.yaml", "prod: true\n")
+	c.SetLayerDirs([]string{"defaults.d", "service.d"}, compose.DiscoverOptions{})
+	c.SetProfiles("prod")
+	c.AddMemoryLayer(compose.MemoryLayer{Order: 4, MemoryFile: compose.MemoryFile{Name: "tenant", Value: map[string]any{"tenant": true}}})
+
+	selected, err := c.SelectedLayers()
+	require.NoError(err)
+	require.Equal([]string{
+		"defaults.d/1-platform.yaml",
+		"service.d/2-app.yaml",
+		"service.d/prod/2-app.yaml",
+		"defaults.d/3-platform-final.yaml",
+		"tenant",
+	}, selected)
+
+	c.SetLayerSelection(compose.LayerSelection{From: "2-*", Until: "3-*", Skip: []string{"prod/*"}})
+	selected, err = c.SelectedLayers()
+	require.NoError(err)
+	require.Equal([]string{"service.d/2-app.yaml", "defaults.d/3-platform-final.yaml"}, selected)
+
+	c.SetLayerSelection(compose.LayerSelection{Only: []string{"2-app.yaml", "tenant"}})
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal([]string{"service.d/2-app.yaml", "service.d/prod/2-app.yaml", "tenant"}, result.LayersApplied)
+
+	for _, tc := range []struct {
+		sel     compose.LayerSelection
+		message string
+	}{
+		{compose.LayerSelection{Only: []string{"9-*"}}, `layer "9-*" not found`},
+		{compose.LayerSelection{From: "9-*"}, `from layer "9-*" not found`},
+		{compose.LayerSelection{Skip: []string{"8-*"}}, `skipped layer "8-*" not found`},
+		{compose.LayerSelection{From: "3-*", Until: "1-*"}, `from layer "defaults.d/3-platform-final.yaml" comes after until layer "defaults.d/1-platform.yaml"`},
+		{compose.LayerSelection{Until: "["}, `invalid layer glob "["`},
+	} {
+		c.SetLayerSelection(tc.sel)
+		_, err = c.Run()
+		require.Error(err)
+		require.Contains(err.Error(), tc.message)
+	}
+}
+
+func TestComposeMergesListItemsByKey(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-prod.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `app:
+  backends:
+    - name: api
+      host: api.internal
+      ports: [8080]
+    - name: web
+      host: web.internal
+  routes:
+    - {host: a.example.com, path: /, backend: web}
+    - {host: a.example.com, path: /api, backend: api}
+`)
+	writeLayerFile(t, fs, baseDir, "1-prod.yaml", `operators:
+  - kind: merge
+    merge:
+      paths:
+        app.backends:
+          list: merge_by
+          key: name
+        app.backends[name=api].ports:
+          list: append
+        app.routes:
+          list: merge_by
+          key: [host, path]
+---
+app:
+  backends:
+    - name: worker
+      host: worker.internal
+    - name: api
+      host: api.prod
+      ports: [8443]
+  routes:
+    - {host: a.example.com, path: /api, backend: api-v2}
+    - {host: b.example.com, path: /, backend: web}
+`)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal(`app:
+  backends:
+    - name: api
+      host: api.prod
+      ports: [8080, 8443]
+    - name: web
+      host: web.internal
+    - name: worker
+      host: worker.internal
+  routes:
+    - {host: a.example.com, path: /, backend: web}
+    - {host: a.example.com, path: /api, backend: api-v2}
+    - {host: b.example.com, path: /, backend: web}
+`, out)
+
+	result, err := c.Compose(context.Background())
+	require.NoError(err)
+	require.Equal("1-prod.yaml", result.Provenance["app.backends[0].host"].Layer)
+	require.Equal("base.yaml", result.Provenance["app.backends[1].host"].File)
+}
+
+func TestComposeReportsMergeByErrors(t *testing.T) {
+	require := require.New(t)
+
+	for _, tc := range []struct {
+		merge   string
+		data    string
+		message string
+	}{
+		{
+			merge:   "paths:\n        items:\n          list: merge_by\n",
+			message: `invalid merge.paths."items": list strategy "merge_by" requires key`,
+		},
+		{
+			merge:   "paths:\n        items:\n          list: append\n          key: name\n",
+			message: `invalid merge.paths."items": key is only supported with list strategy "merge_by"`,
+		},
+		{
+			merge:   "defaults:\n        list: merge_by\n        key: name\n",
+			message: `invalid merge.defaults: list strategy "merge_by" is only supported in merge.paths`,
+		},
+		{
+			merge:   "paths:\n        items:\n          list: merge_by\n          key: {name: 1}\n",
+			message: "key must be a field path or a non-empty list of field paths",
+		},
+		{
+			merge:   "paths:\n        items:\n          list: merge_by\n          key: name\n",
+			data:    "items:\n  - id: 2\n",
+			message: `cannot merge_by "items": layer item 0: missing key "name"`,
+		},
+	} {
+		c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+		fs := c.GetFilesystem()
+		baseDir := writeBaseFile(t, fs, "base.yaml", "items:\n  - name: a\n")
+		data := tc.data
+		if data == "" {
+			data = "items: []\n"
+		}
+		writeLayerFile(t, fs, baseDir, "1-layer.yaml", "operators:\n  - kind: merge\n    merge:\n      "+tc.merge+"---\n"+data)
+
+		_, err := c.Run()
+		require.Error(err)
+		require.Contains(err.Error(), tc.message)
+	}
+}
+
+func TestComposeMergesListsAsSets(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-network.yaml", "2-extract.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `cidrs: [10.0.0.0/8, 192.168.0.0/16]
+features: [a, b, c, b]
+regions: [eu, us, ap]
+ports: [{port: 80}, {port: 443}]
+hosts: [h1]
+servers:
+  - {name: h1}
+  - {name: h2}
+  - {name: h1}
+`)
+	writeLayerFile(t, fs, baseDir, "1-network.yaml", `operators:
+  - kind: merge
+    merge:
+      defaults:
+        list: union
+      paths:
+        features:
+          list: subtract
+        regions:
+          list: intersect
+---
+cidrs: [172.16.0.0/12, 10.0.0.0/8]
+features: [b]
+regions: [ap, eu, eu]
+ports: [{port: 443}, {port: 8443}]
+`)
+	writeLayerFile(t, fs, baseDir, "2-extract.yaml", `operators:
+  - kind: list_extract
+    source:
+      from: state
+      path: servers
+    target:
+      path: hosts
+      merge:
+        defaults:
+          list: union
+    list_extract:
+      extract_path: name
+`)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal(`cidrs: [10.0.0.0/8, 192.168.0.0/16, 172.16.0.0/12]
+features: [a, c]
+regions: [eu, ap]
+ports: [{port: 80}, {port: 443}, {port: 8443}]
+hosts: [h1, h2]
+servers:
+  - {name: h1}
+  - {name: h2}
+  - {name: h1}
+`, out)
+}
+
+func TestComposeMergesMapsWithKeepAndReplaceKeys(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `secrets:
+  token: base
+  db:
+    password: base
+limits:
+  cpu: {max: 2, min: 1}
+  memory: 1Gi
+`)
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", `operators:
+  - kind: merge
+    merge:
+      paths:
+        secrets:
+          map: keep
+        limits:
+          map: replace_keys
+---
+secrets:
+  token: layer
+  region: eu
+  db:
+    password: layer
+    user: app
+limits:
+  cpu: {max: 4}
+  disk: 10Gi
+`)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal(`secrets:
+  token: base
+  db:
+    password: base
+    user: app
+  region: eu
+limits:
+  cpu: {max: 4}
+  memory: 1Gi
+  disk: 10Gi
+`, out)
+}
+
+func TestComposeStrictMapMerge(t *testing.T) {
+	require := require.New(t)
+
+	for _, tc := range []struct {
+		data    string
+		out     string
+		message string
+	}{
+		{
+			data: "app:\n  port: 80\n  db:\n    host: db\n    user: app\n",
+			out:  "app:\n  port: 80\n  db:\n    host: db\n    user: app\n  name: web\n",
+		},
+		{
+			data:    "app:\n  db:\n    host: other\n",
+			message: `strict merge: cannot change "app.db.host" from db to other`,
+		},
+		{
+			data:    "app: null\n",
+			message: `strict merge: cannot change "app" from`,
+		},
+	} {
+		c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+		fs := c.GetFilesystem()
+		baseDir := writeBaseFile(t, fs, "base.yaml", "app:\n  port: 80\n  db:\n    host: db\n  name: web\n")
+		writeLayerFile(t, fs, baseDir, "1-layer.yaml", "operators:\n  - kind: merge\n    merge:\n      paths:\n        app:\n          map: strict\n---\n"+tc.data)
+
+		out, err := c.Run()
+		if tc.message != "" {
+			require.Error(err)
+			require.Contains(err.Error(), tc.message)
+			continue
+		}
+		require.NoError(err)
+		require.Equal(tc.out, out)
+	}
+}
+
+func TestComposeStrictMapMergeRejectsInlineDirectives(t *testing.T) {
+	require := require.New(t)
+
+	for _, tc := range []struct {
+		data    string
+		out     string
+		message string
+	}{
+		{
+			data:    "app:\n  auth: !delete\n",
+			message: `strict merge: cannot delete "app.auth"`,
+		},
+		{
+			data:    "app:\n  auth: !override\n    key: other\n",
+			message: `strict merge: cannot change "app.auth" from {key: base, ttl: 1} to {key: other}`,
+		},
+		{
+			data:    "app:\n  auth:\n    ttl: !override 2\n",
+			message: `strict merge: cannot change "app.auth.ttl" from 1 to 2`,
+		},
+		{
+			data:    "app:\n  auth:\n    key: !delete\n",
+			message: `strict merge: cannot delete "app.auth.key"`,
+		},
+		{
+			data: "app:\n  auth: !override\n    key: base\n    ttl: 1\n  name: !delete\n",
+			out:  "app:\n  auth:\n    key: base\n    ttl: 1\n",
+		},
+	} {
+		c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+		fs := c.GetFilesystem()
+		baseDir := writeBaseFile(t, fs, "base.yaml", "app:\n  auth:\n    key: base\n    ttl: 1\n  name: web\n")
+		writeLayerFile(t, fs, baseDir, "1-layer.yaml", "operators:\n  - kind: merge\n    merge:\n      paths:\n        app.auth:\n          map: strict\n---\n"+tc.data)
+
+		out, err := c.Run()
+		if tc.message != "" {
+			require.Error(err, tc.data)
+			require.Contains(err.Error(), tc.message)
+
+			var pathErr *compose.PathError
+			require.ErrorAs(err, &pathErr)
+			continue
+		}
+		require.NoError(err, tc.data)
+		require.Equal(tc.out, out)
+	}
+}
+
+func TestComposeAppliesWildcardMergePaths(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `app:
+  services:
+    api:
+      ports: [80]
+      hosts: [a]
+    web:
+      ports: [8080]
+      hosts: [b]
+  tags: [base]
+`)
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", `operators:
+  - kind: merge
+    merge:
+      paths:
+        app.services.**:
+          list: append
+        app.services.*.hosts:
+          list: union
+        app.services.web.hosts:
+          list: override
+---
+app:
+  services:
+    api:
+      ports: [443]
+      hosts: [a, c]
+    web:
+      ports: [8443]
+      hosts: [d]
+  tags: [layer]
+`)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal(`app:
+  services:
+    api:
+      ports: [80, 443]
+      hosts: [a, c]
+    web:
+      ports: [8080, 8443]
+      hosts: [d]
+  tags: [layer]
+`, out)
+}
+
+func TestComposeAppliesInlineMergeDirectives(t *testing.T) {
+	require := require.New(t)
+
+	c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+	fs := c.GetFilesystem()
+
+	baseDir := writeBaseFile(t, fs, "base.yaml", `app:
+  ports: [5432]
+  hosts: [a]
+  tags: [base]
+  backends:
+    - {name: api, port: 80}
+  limits: {cpu: 1, memory: 1Gi}
+  secret: base
+  debug: true
+  env: {A: "1"}
+`)
+	writeLayerFile(t, fs, baseDir, "1-layer.yaml", `operators:
+  - kind: merge
+    merge:
+      paths:
+        app.tags:
+          list: append
+---
+app:
+  ports: !append [5433]
+  hosts: !prepend [b]
+  tags: !override [layer]
+  backends: !merge_by:name
+    - {name: api, port: 443}
+    - {name: web, port: 8080}
+  limits: !override {cpu: 2}
+  secret: !keep layer
+  debug: !delete
+  env:
+    B: !keep "2"
+    C: !delete
+`)
+
+	out, err := c.Run()
+	require.NoError(err)
+	require.Equal(`app:
+  ports: [5432, 5433]
+  hosts: [b, a]
+  tags: [layer]
+  backends:
+    - {name: api, port: 443}
+    - {name: web, port: 8080}
+  limits: {cpu: 2}
+  secret: base
+  env: {A: "1", B: "2"}
+`, out)
+}
+
+func TestComposeReportsInvalidMergeDirectives(t *testing.T) {
+	require := require.New(t)
+
+	for data, message := range map[string]string{
+		"app:\n  port: !append 80\n":    "line 2, column 9: !append is only supported on lists, got int",
+		"app:\n  - !delete a\n":         "!delete is only supported on mapping values",
+		"app:\n  items: !merge_by []\n": "!merge_by requires a key, e.g. !merge_by:name",
+	} {
+		c := compose.NewMock("base.yaml", []string{"1-layer.yaml"})
+		fs := c.GetFilesystem()
+		baseDir := writeBaseFile(t, fs, "base.yaml", "app: {}\n")
+		writeLayerFile(t, fs, baseDir, "1-layer.yaml", data)
+
+		_, err := c.Run()
+		require.Error(err, data)
+		require.Contains(err.Error(), message, data)
+	}
+}
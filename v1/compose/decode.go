@@ -0,0 +1,183 @@
+package compose
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DecodeError reports a composed value that does not fit the type it is
+// decoded into, or a field the type does not know in strict mode.
+type DecodeError struct {
+	// Path is the composed path of the value, e.g. "app.db.ports[1]"; empty
+	// for the document root.
+	Path string
+	// Origin is where the value came from; the zero Origin when unknown.
+	Origin Origin
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	from := ""
+	if origin := e.Origin.String(); origin != "" {
+		from = " set by " + origin
+	}
+	return fmt.Sprintf("cannot decode %s%s: %v", jsonPathName(e.Path), from, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// Decode composes the layers configured by opts and decodes the result into
+// a T using its yaml struct tags.
+func Decode[T any](ctx context.Context, opts Options) (T, error) {
+	var out T
+	err := NewWithOptions(opts).DecodeInto(ctx, &out)
+	return out, err
+}
+
+// SetStrictDecode makes DecodeInto report fields the target type does not
+// know.  Type mismatches are always reported.
+func (c *Compose) SetStrictDecode(strict bool) {
+	c.strictDecode = strict
+}
+
+// DecodeInto composes the layers and decodes the result into out, which must
+// be a pointer.  Values that do not fit are reported as DecodeErrors naming
+// the composed path and the layer that supplied the value; several problems
+// are returned together in a ValidationError.
+func (c *Compose) DecodeInto(ctx context.Context, out any) error {
+	result, run, err := c.compose(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Decode a block-style rendering so every value starts on a line of its
+	// own, then map the lines in decoder errors back to composed paths.
+	in, err := MarshalYAML(blockStyleCopy(result.Document))
+	if err != nil {
+		return fmt.Errorf("failed to decode compose result: %w", err)
+	}
+	var rendered yaml.Node
+	if err := yaml.Unmarshal(in, &rendered); err != nil {
+		return fmt.Errorf("failed to decode compose result: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(in))
+	decoder.KnownFields(c.strictDecode)
+	err = decoder.Decode(out)
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		if err != nil {
+			return fmt.Errorf("failed to decode compose result: %w", err)
+		}
+		return nil
+	}
+
+	lines := decodeLineIndex{}
+	lines.add(&rendered, result.Document, "")
+	errs := make([]error, 0, len(typeErr.Errors))
+	for _, msg := range typeErr.Errors {
+		errs = append(errs, run.newDecodeError(lines, msg))
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return &ValidationError{Errors: errs}
+}
+
+// blockStyleCopy returns a copy of n without flow styles or comments.
+func blockStyleCopy(n *yaml.Node) *yaml.Node {
+	out := *n
+	out.Style &^= yaml.FlowStyle
+	out.HeadComment, out.LineComment, out.FootComment = "", "", ""
+	if len(n.Content) > 0 {
+		out.Content = make([]*yaml.Node, len(n.Content))
+		for i, child := range n.Content {
+			out.Content[i] = blockStyleCopy(child)
+		}
+	}
+	return &out
+}
+
+// decodeLineEntry is a composed value, or a mapping key when key is set,
+// found on one line of the rendering handed to the decoder.
+type decodeLineEntry struct {
+	path  string
+	node  *yaml.Node
+	tag   string
+	key   string
+	isKey bool
+}
+
+type decodeLineIndex map[int][]decodeLineEntry
+
+// add indexes the nodes of rendered by line, walking composed in parallel to
+// know their paths and original nodes.
+func (idx decodeLineIndex) add(rendered *yaml.Node, composed *yaml.Node, path string) {
+	if rendered.Kind == yaml.DocumentNode {
+		if len(rendered.Content) > 0 && len(composed.Content) > 0 {
+			idx.add(rendered.Content[0], composed.Content[0], path)
+		}
+		return
+	}
+
+	idx[rendered.Line] = append(idx[rendered.Line], decodeLineEntry{path: path, node: composed, tag: rendered.ShortTag()})
+	switch rendered.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(rendered.Content) && i+1 < len(composed.Content); i += 2 {
+			key := rendered.Content[i]
+			keyPath := joinPathKey(path, key.Value)
+			idx[key.Line] = append(idx[key.Line], decodeLineEntry{path: keyPath, node: composed.Content[i+1], key: key.Value, isKey: true})
+			idx.add(rendered.Content[i+1], composed.Content[i+1], keyPath)
+		}
+	case yaml.SequenceNode:
+		for i := 0; i < len(rendered.Content) && i < len(composed.Content); i++ {
+			idx.add(rendered.Content[i], composed.Content[i], joinPathIndex(path, i))
+		}
+	}
+}
+
+var (
+	decodeErrorPattern        = regexp.MustCompile(`^line (\d+): (.*)$`)
+	decodeUnknownFieldPattern = regexp.MustCompile(`^field (.+) not found in type `)
+	decodeMismatchPattern     = regexp.MustCompile(`^cannot unmarshal (!!\w+)`)
+)
+
+// newDecodeError turns one yaml.TypeError message into a DecodeError for the
+// composed value on the line it names.
+func (c *composeRun) newDecodeError(lines decodeLineIndex, msg string) error {
+	m := decodeErrorPattern.FindStringSubmatch(msg)
+	if m == nil {
+		return &DecodeError{Err: errors.New(msg)}
+	}
+	line, _ := strconv.Atoi(m[1])
+	decodeErr := &DecodeError{Err: errors.New(m[2])}
+
+	entries := lines[line]
+	match := func(entry decodeLineEntry) bool { return !entry.isKey }
+	if field := decodeUnknownFieldPattern.FindStringSubmatch(m[2]); field != nil {
+		match = func(entry decodeLineEntry) bool { return entry.isKey && entry.key == field[1] }
+	} else if tag := decodeMismatchPattern.FindStringSubmatch(m[2]); tag != nil {
+		match = func(entry decodeLineEntry) bool { return !entry.isKey && entry.tag == tag[1] }
+	}
+	for _, entry := range entries {
+		if match(entry) {
+			decodeErr.Path = entry.path
+			decodeErr.Origin = c.valueOrigin(entry.node)
+			break
+		}
+	}
+	return decodeErr
+}
+
+// valueOrigin returns the origin of n; for a collection, the origin of its
+// newest value, the layer that wrote into it last.
+func (c *composeRun) valueOrigin(n *yaml.Node) Origin {
+	origin, _ := c.provenance.origin(n)
+	return origin
+}
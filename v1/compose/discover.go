@@ -0,0 +1,155 @@
+package compose
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// NewFromFS returns a Compose reading the base file, its layers and
+// source.file files from fsys, e.g. an embed.FS.  Paths are slash-separated
+// and relative to the root of fsys.  Every run discovers the layers in
+// layerDir, or in "<base>.d" when layerDir is empty, with DiscoverLayers and
+// the active profiles.
+func NewFromFS(fsys fs.FS, base string, layerDir string) (*Compose, error) {
+	c := NewWithFs(base, nil, afero.FromIOFS{FS: fsys})
+	c.SetLayerDir(layerDir)
+
+	if _, err := c.fs.Stat(c.layerDir()); err != nil {
+		return nil, fmt.Errorf("failed to read layer directory %q: %w", c.layerDir(), err)
+	}
+	c.discoverLayerDir = true
+	return c, nil
+}
+
+// DiscoverOptions narrows the layers found by DiscoverLayers.  Globs use
+// path.Match syntax.  A glob without a "/" is matched against the layer
+// filename, one with a "/" against the path relative to the layer directory,
+// e.g. "prod/*".
+type DiscoverOptions struct {
+	// Include keeps only layers matching at least one glob; every layer
+	// when empty.
+	Include []string
+	// Exclude drops layers matching any glob.
+	Exclude []string
+	// Profiles activates the subdirectories with these names, e.g. "prod"
+	// for "base.yaml.d/prod/".  Subdirectories of an active subdirectory are
+	// activated the same way.  Other subdirectories are skipped.
+	Profiles []string
+}
+
+// DiscoverLayers returns the layers in dir, in layer order.  Layers of the
+// top level are returned by filename and layers of profile subdirectories by
+// their path relative to dir, e.g. "prod/20-db.yaml".  Layers of all
+// directories are interleaved in layer order; a profile layer with the same
+// filename as another layer is applied after it, in the order the profiles
+// are listed.
+//
+// Only .yaml, .yml, .json and .toml files are layers; hidden files and editor
+// backups such as "1-app.yaml~" or "#1-app.yaml#" are skipped.
+func DiscoverLayers(fs afero.Fs, dir string, opts DiscoverOptions) ([]string, error) {
+	if err := validateGlobs(opts.Include); err != nil {
+		return nil, err
+	}
+	if err := validateGlobs(opts.Exclude); err != nil {
+		return nil, err
+	}
+
+	layers := make([]string, 0)
+	if err := discoverLayersIn(fs, dir, "", opts, &layers); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(layers, NewLayerComparator(layers))
+	return layers, nil
+}
+
+// discoverLayersIn appends the layers of dir/rel to layers, then those of
+// its active profile subdirectories.
+func discoverLayersIn(fs afero.Fs, dir string, rel string, opts DiscoverOptions, layers *[]string) error {
+	infos, err := afero.ReadDir(fs, filepath.Join(dir, rel))
+	if err != nil {
+		if rel != "" {
+			return fmt.Errorf("failed to read profile directory %q: %w", filepath.Join(dir, rel), err)
+		}
+		return fmt.Errorf("failed to read layer directory %q: %w", dir, err)
+	}
+
+	subdirs := map[string]bool{}
+	for _, info := range infos {
+		name := info.Name()
+		if isHiddenOrBackupFile(name) {
+			continue
+		}
+		if info.IsDir() {
+			subdirs[name] = true
+			continue
+		}
+		if !isComposeFile(name) {
+			continue
+		}
+		layer := filepath.Join(rel, name)
+		if len(opts.Include) > 0 && !matchesAnyGlob(layer, opts.Include) {
+			continue
+		}
+		if matchesAnyGlob(layer, opts.Exclude) {
+			continue
+		}
+		*layers = append(*layers, layer)
+	}
+
+	for _, profile := range opts.Profiles {
+		if !subdirs[profile] {
+			continue
+		}
+		delete(subdirs, profile)
+		if err := discoverLayersIn(fs, dir, filepath.Join(rel, profile), opts, layers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isHiddenOrBackupFile reports whether name is a dot file or a backup or
+// lock file left by an editor.
+func isHiddenOrBackupFile(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "."):
+		return true
+	case strings.HasSuffix(name, "~"):
+		return true
+	case strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#"):
+		return true
+	default:
+		return false
+	}
+}
+
+func validateGlobs(globs []string) error {
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid layer glob %q: %w", glob, err)
+		}
+	}
+	return nil
+}
+
+// matchesAnyGlob reports whether layer, a path relative to the layer
+// directory, matches one of globs.
+func matchesAnyGlob(layer string, globs []string) bool {
+	slashed := filepath.ToSlash(layer)
+	for _, glob := range globs {
+		name := slashed
+		if !strings.Contains(glob, "/") {
+			name = path.Base(slashed)
+		}
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package compose
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LayerParseError reports a layer file that is not valid YAML, does not use
+// the expected document layout or carries invalid operators metadata.
+type LayerParseError struct {
+	// Layer is the layer filename.
+	Layer string
+	// File is the path the layer was read from.
+	File string
+	// Line and Column locate the offending node in File; 0 when unknown.
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *LayerParseError) Error() string {
+	return fmt.Sprintf("failed to parse layer compose file %q%s: %v", e.File, atPosition(e.Line, e.Column), e.Err)
+}
+
+func (e *LayerParseError) Unwrap() error { return e.Err }
+
+// TemplateError reports a layer whose template could not be parsed or
+// rendered.
+type TemplateError struct {
+	// Layer is the layer filename.
+	Layer string
+	// File is the path the layer was read from.
+	File string
+	// Op is "parse" or "render".
+	Op string
+	// Line is the template line that failed; 0 when unknown.
+	Line int
+	Err  error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("failed to %s layer template for %q: %v", e.Op, e.Layer, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error { return e.Err }
+
+// OperatorConfigError reports an invalid field in a layer's operators
+// metadata.  It is wrapped in a LayerParseError.
+type OperatorConfigError struct {
+	// Layer is the layer filename.
+	Layer string
+	// Operator is the index in the layer's operators list.
+	Operator int
+	// Field is the full field name, e.g. "operators[0].source.path".
+	Field string
+	// Line and Column locate the field, or its closest enclosing node when
+	// the field is missing; 0 when unknown.
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *OperatorConfigError) Error() string { return e.Err.Error() }
+
+func (e *OperatorConfigError) Unwrap() error { return e.Err }
+
+// OperatorError reports a layer operator that failed while it was applied.
+type OperatorError struct {
+	// Layer is the layer filename.
+	Layer string
+	// File is the path the layer was read from.
+	File string
+	// Operator is the index of the operator, counting the implicit merge
+	// operator appended after the declared ones.
+	Operator int
+	// Kind is the operator kind.
+	Kind string
+	// Line and Column locate the operator in File; 0 for the implicit merge
+	// operator.
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *OperatorError) Error() string {
+	return fmt.Sprintf("failed to apply layer operator operators[%d] (kind=%q) in layer %q%s: %v", e.Operator, e.Kind, e.Layer, atPosition(e.Line, e.Column), e.Err)
+}
+
+func (e *OperatorError) Unwrap() error { return e.Err }
+
+// PathError reports a path that cannot be parsed, resolved or written.  Its
+// message is the message of Err.
+type PathError struct {
+	// Path is the path as written, e.g. "app.backends[name=api]".
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string { return e.Err.Error() }
+
+func (e *PathError) Unwrap() error { return e.Err }
+
+// SourceFileError reports a source.file that could not be read or parsed.
+type SourceFileError struct {
+	// Layer is the layer filename of the operator reading the file.
+	Layer string
+	// Operator is the index of that operator in the layer's operators list.
+	Operator int
+	// File is the resolved path of the source file.
+	File string
+	// Op is "read" or "parse".
+	Op string
+	// Line and Column locate a parse error in File; 0 when unknown.
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *SourceFileError) Error() string {
+	return fmt.Sprintf("failed to %s transform source file %q: %v", e.Op, e.File, e.Err)
+}
+
+func (e *SourceFileError) Unwrap() error { return e.Err }
+
+// ValidationError lists every problem found by Compose.Validate, or every
+// value Compose.DecodeInto could not decode.
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "found %d problem(s):", len(e.Errors))
+	for _, err := range e.Errors {
+		out.WriteString("\n  ")
+		out.WriteString(err.Error())
+	}
+	return out.String()
+}
+
+func (e *ValidationError) Unwrap() []error { return e.Errors }
+
+// atPosition renders " at line L, column C" for error messages, omitting
+// unknown parts.
+func atPosition(line int, column int) string {
+	switch {
+	case line <= 0:
+		return ""
+	case column <= 0:
+		return fmt.Sprintf(" at line %d", line)
+	default:
+		return fmt.Sprintf(" at line %d, column %d", line, column)
+	}
+}
+
+var syntaxErrorLinePattern = regexp.MustCompile(`^(?:(?:yaml|json|toml): )?line (\d+):`)
+
+// syntaxErrorLine extracts the line from a YAML, JSON or TOML syntax error or
+// a yaml.v3 type error, which carry it only in the message.
+func syntaxErrorLine(err error) int {
+	msg := err.Error()
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		msg = typeErr.Errors[0]
+	}
+
+	m := syntaxErrorLinePattern.FindStringSubmatch(msg)
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line
+}
+
+var templateErrorLinePattern = regexp.MustCompile(`^template: [^:]*:(\d+)`)
+
+// templateErrorLine extracts the line from a text/template error.
+func templateErrorLine(err error) int {
+	m := templateErrorLinePattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line
+}
@@ -0,0 +1,388 @@
+package compose
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"gopkg.in/yaml.v3"
+)
+
+// KeyCase selects the casing of flattened keys.
+type KeyCase string
+
+const (
+	KeyCasePreserve KeyCase = "preserve"
+	KeyCaseUpper    KeyCase = "upper"
+	KeyCaseLower    KeyCase = "lower"
+)
+
+// ListIndexStyle selects how list items appear in flattened keys.
+type ListIndexStyle string
+
+const (
+	// ListIndexSegment adds the index as a key segment: APP_HOSTS_0.
+	ListIndexSegment ListIndexStyle = "segment"
+	// ListIndexBracket appends the index in brackets: app.hosts[0].
+	ListIndexBracket ListIndexStyle = "bracket"
+	// ListIndexJSON writes the whole list as one JSON value.
+	ListIndexJSON ListIndexStyle = "json"
+)
+
+// QuoteStyle selects how env values are quoted.  Properties values are
+// escaped instead and ignore it.
+type QuoteStyle string
+
+const (
+	// QuoteAuto double-quotes values that contain anything but letters,
+	// digits and _ . / : @ % + , = -.
+	QuoteAuto   QuoteStyle = "auto"
+	QuoteDouble QuoteStyle = "double"
+	QuoteSingle QuoteStyle = "single"
+	QuoteNone   QuoteStyle = "none"
+)
+
+// UnrepresentableMode selects what happens to values a flat format cannot
+// hold: empty maps and lists, and strings the quote style cannot express.
+type UnrepresentableMode string
+
+const (
+	UnrepresentableError UnrepresentableMode = "error"
+	// UnrepresentableJSON writes the value as compact JSON instead.
+	UnrepresentableJSON UnrepresentableMode = "json"
+)
+
+// FlattenOptions controls the env and properties output formats.  Empty
+// fields take the defaults of the format.
+type FlattenOptions struct {
+	// Separator joins key segments; "_" for env and "." for properties.
+	Separator string
+	// KeyCase defaults to upper for env and preserve for properties.
+	KeyCase KeyCase
+	// Prefix is joined in front of every key with Separator, unchanged by
+	// KeyCase.
+	Prefix string
+	// ListIndex defaults to segment for env and bracket for properties.
+	ListIndex ListIndexStyle
+	// Quote defaults to auto.
+	Quote QuoteStyle
+	// Unrepresentable defaults to error.
+	Unrepresentable UnrepresentableMode
+}
+
+// NewEnvMarshaller returns a MarshalFunc writing KEY=value lines for
+// environment files, e.g. APP_DB_HOST=prod.  Characters that are not valid
+// in environment variable names are replaced by "_"; keys that collide once
+// replaced, such as db-host and db_host, are reported.
+func NewEnvMarshaller(opts FlattenOptions) (MarshalFunc, error) {
+	opts = opts.withDefaults(FlattenOptions{
+		Separator: "_",
+		KeyCase:   KeyCaseUpper,
+		ListIndex: ListIndexSegment,
+	})
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return func(in any) ([]byte, error) {
+		return marshalFlat(in, opts, envName, writeEnvLine)
+	}, nil
+}
+
+// NewPropertiesMarshaller returns a MarshalFunc writing Java properties
+// lines, e.g. app.db.host=prod, escaped the way java.util.Properties reads
+// them.
+func NewPropertiesMarshaller(opts FlattenOptions) (MarshalFunc, error) {
+	opts = opts.withDefaults(FlattenOptions{
+		Separator: ".",
+		KeyCase:   KeyCasePreserve,
+		ListIndex: ListIndexBracket,
+	})
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return func(in any) ([]byte, error) {
+		return marshalFlat(in, opts, nil, writePropertiesLine)
+	}, nil
+}
+
+func (o FlattenOptions) withDefaults(defaults FlattenOptions) FlattenOptions {
+	if o.Separator == "" {
+		o.Separator = defaults.Separator
+	}
+	if o.KeyCase == "" {
+		o.KeyCase = defaults.KeyCase
+	}
+	if o.ListIndex == "" {
+		o.ListIndex = defaults.ListIndex
+	}
+	if o.Quote == "" {
+		o.Quote = QuoteAuto
+	}
+	if o.Unrepresentable == "" {
+		o.Unrepresentable = UnrepresentableError
+	}
+	return o
+}
+
+func (o FlattenOptions) validate() error {
+	switch o.KeyCase {
+	case KeyCasePreserve, KeyCaseUpper, KeyCaseLower:
+	default:
+		return fmt.Errorf("invalid key case %q: supported values: preserve, upper, lower", o.KeyCase)
+	}
+	switch o.ListIndex {
+	case ListIndexSegment, ListIndexBracket, ListIndexJSON:
+	default:
+		return fmt.Errorf("invalid list index style %q: supported values: segment, bracket, json", o.ListIndex)
+	}
+	switch o.Quote {
+	case QuoteAuto, QuoteDouble, QuoteSingle, QuoteNone:
+	default:
+		return fmt.Errorf("invalid quote style %q: supported values: auto, double, single, none", o.Quote)
+	}
+	switch o.Unrepresentable {
+	case UnrepresentableError, UnrepresentableJSON:
+	default:
+		return fmt.Errorf("invalid unrepresentable mode %q: supported values: error, json", o.Unrepresentable)
+	}
+	return nil
+}
+
+// flatValue is one flattened key with its value.  json marks values that
+// were rendered as JSON.
+type flatValue struct {
+	path  string
+	key   string
+	value string
+	json  bool
+}
+
+// flatLineWriter writes one line for v, or reports why the format cannot
+// represent it.
+type flatLineWriter func(out *bytes.Buffer, v flatValue, opts FlattenOptions) error
+
+// marshalFlat writes the leaves of in with writeLine.  keyName, when set,
+// turns a flattened key into the name written, so keys that only collide once
+// rewritten are reported like any other duplicate.
+func marshalFlat(in any, opts FlattenOptions, keyName func(string) string, writeLine flatLineWriter) ([]byte, error) {
+	n, err := toYAMLNode(in)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]flatValue, 0)
+	if err := flattenNode(n, "", nil, opts, &values); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	seen := make(map[string]string, len(values))
+	for _, v := range values {
+		if keyName != nil {
+			v.key = keyName(v.key)
+		}
+		if other, ok := seen[v.key]; ok {
+			return nil, fmt.Errorf("cannot flatten %q: key %s is also produced by %q", v.path, v.key, other)
+		}
+		seen[v.key] = v.path
+
+		if err := writeLine(&out, v, opts); err != nil {
+			if opts.Unrepresentable != UnrepresentableJSON || v.json {
+				return nil, fmt.Errorf("cannot flatten %q: %w", v.path, err)
+			}
+			v.value, v.json = mustCompactJSON(newStringNode(v.value)), true
+			if err := writeLine(&out, v, opts); err != nil {
+				return nil, fmt.Errorf("cannot flatten %q: %w", v.path, err)
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// flattenNode appends the leaves below n.  path is the composed path used in
+// errors; segments are the key segments built so far.
+func flattenNode(n *yaml.Node, path string, segments []string, opts FlattenOptions, values *[]flatValue) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil
+		}
+		return flattenNode(n.Content[0], path, segments, opts, values)
+	case yaml.AliasNode:
+		return flattenNode(n.Alias, path, segments, opts, values)
+	}
+
+	if len(n.Content) == 0 || (n.Kind == yaml.SequenceNode && opts.ListIndex == ListIndexJSON) {
+		return flattenLeaf(n, path, segments, opts, values)
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := jsonObjectKey(n.Content[i])
+			if err := flattenNode(n.Content[i+1], joinPathKey(path, key), append(segments[:len(segments):len(segments)], key), opts, values); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			child := append(segments[:len(segments):len(segments)], fmt.Sprintf("%d", i))
+			if opts.ListIndex == ListIndexBracket && len(segments) > 0 {
+				child = append(segments[:len(segments)-1:len(segments)-1], fmt.Sprintf("%s[%d]", segments[len(segments)-1], i))
+			}
+			if err := flattenNode(item, joinPathIndex(path, i), child, opts, values); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func flattenLeaf(n *yaml.Node, path string, segments []string, opts FlattenOptions, values *[]flatValue) error {
+	if len(segments) == 0 {
+		if n.Kind == yaml.MappingNode {
+			return nil
+		}
+		return fmt.Errorf("cannot flatten document root: expected an object, got %s", nodeKindName(n))
+	}
+
+	v := flatValue{path: path, key: flatKey(segments, opts)}
+	switch {
+	case n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null":
+	case n.Kind == yaml.ScalarNode:
+		v.value = n.Value
+	case n.Kind == yaml.SequenceNode && opts.ListIndex == ListIndexJSON:
+		out, err := MarshalJSONCompact(n)
+		if err != nil {
+			return err
+		}
+		v.value, v.json = string(bytes.TrimSuffix(out, []byte("\n"))), true
+	case opts.Unrepresentable == UnrepresentableJSON:
+		v.value, v.json = mustCompactJSON(n), true
+	default:
+		return fmt.Errorf("cannot flatten %q: empty %s has no flat representation", path, nodeKindName(n))
+	}
+
+	*values = append(*values, v)
+	return nil
+}
+
+func mustCompactJSON(n *yaml.Node) string {
+	out, err := MarshalJSONCompact(n)
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimSuffix(out, []byte("\n")))
+}
+
+func flatKey(segments []string, opts FlattenOptions) string {
+	key := strings.Join(segments, opts.Separator)
+	switch opts.KeyCase {
+	case KeyCaseUpper:
+		key = strings.ToUpper(key)
+	case KeyCaseLower:
+		key = strings.ToLower(key)
+	}
+	if opts.Prefix != "" {
+		key = opts.Prefix + opts.Separator + key
+	}
+	return key
+}
+
+var (
+	envInvalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+	envBareValue        = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+)
+
+// envName replaces the characters not allowed in environment variable names
+// by "_".
+func envName(key string) string {
+	return envInvalidNameChars.ReplaceAllString(key, "_")
+}
+
+func writeEnvLine(out *bytes.Buffer, v flatValue, opts FlattenOptions) error {
+	key := v.key
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		return fmt.Errorf("key %s is not a valid environment variable name", key)
+	}
+
+	value, err := quoteEnvValue(v.value, opts.Quote)
+	if err != nil {
+		return err
+	}
+	out.WriteString(key)
+	out.WriteByte('=')
+	out.WriteString(value)
+	out.WriteByte('\n')
+	return nil
+}
+
+func quoteEnvValue(value string, style QuoteStyle) (string, error) {
+	switch style {
+	case QuoteNone:
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("value with line breaks needs quoting")
+		}
+		return value, nil
+	case QuoteSingle:
+		if strings.ContainsAny(value, "'\r\n") {
+			return "", fmt.Errorf("value with single quotes or line breaks cannot be single-quoted")
+		}
+		return "'" + value + "'", nil
+	case QuoteAuto:
+		if envBareValue.MatchString(value) {
+			return value, nil
+		}
+	}
+
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`, "\r", `\r`)
+	return `"` + replacer.Replace(value) + `"`, nil
+}
+
+func writePropertiesLine(out *bytes.Buffer, v flatValue, _ FlattenOptions) error {
+	out.WriteString(escapeProperty(v.key, true))
+	out.WriteByte('=')
+	out.WriteString(escapeProperty(v.value, false))
+	out.WriteByte('\n')
+	return nil
+}
+
+// escapeProperty escapes s the way java.util.Properties.store does: every
+// space in keys and leading spaces in values, separators, comment
+// characters, control characters and non-ASCII characters.
+func escapeProperty(s string, isKey bool) string {
+	var out strings.Builder
+	leading := true
+	for _, r := range s {
+		if r != ' ' {
+			leading = false
+		}
+		switch {
+		case r == ' ':
+			if isKey || leading {
+				out.WriteByte('\\')
+			}
+			out.WriteByte(' ')
+		case r == '\\', r == '=', r == ':', r == '#', r == '!':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r == '\t':
+			out.WriteString(`\t`)
+		case r == '\n':
+			out.WriteString(`\n`)
+		case r == '\r':
+			out.WriteString(`\r`)
+		case r == '\f':
+			out.WriteString(`\f`)
+		case r < 0x20 || r > 0x7e:
+			for _, unit := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&out, `\u%04X`, unit)
+			}
+		default:
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,302 @@
+package compose
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// File formats accepted for the base, layers and source files, detected by
+// extension.  Everything that is not JSON or TOML is read as YAML.
+const (
+	fileFormatYAML = "yaml"
+	fileFormatJSON = "json"
+	fileFormatTOML = "toml"
+)
+
+// fileFormat returns the format of filename from its extension.
+func fileFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return fileFormatJSON
+	case ".toml":
+		return fileFormatTOML
+	default:
+		return fileFormatYAML
+	}
+}
+
+// isComposeFile reports whether filename has an extension of a supported
+// file format.
+func isComposeFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".json", ".toml":
+		return true
+	default:
+		return false
+	}
+}
+
+// decodeDocuments parses in as format.  YAML may hold several documents;
+// JSON and TOML always hold exactly one.
+func decodeDocuments(format string, in []byte) ([]*yaml.Node, error) {
+	var root *yaml.Node
+	var err error
+	switch format {
+	case fileFormatJSON:
+		root, err = decodeJSONNode(in)
+	case fileFormatTOML:
+		root, err = decodeTOMLNode(in)
+	default:
+		return decodeYAMLDocuments(in)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, nil
+	}
+	return []*yaml.Node{newDocumentNode(root)}, nil
+}
+
+// decodeJSONNode parses a JSON value into a node tree keeping key order,
+// number literals and the line and column of every value.
+func decodeJSONNode(in []byte) (*yaml.Node, error) {
+	if len(bytes.TrimSpace(in)) == 0 {
+		return nil, nil
+	}
+
+	p := &jsonNodeParser{in: in, decoder: json.NewDecoder(bytes.NewReader(in))}
+	p.decoder.UseNumber()
+
+	root, err := p.parseValue()
+	if err != nil {
+		return nil, p.wrapError(err)
+	}
+	if _, err := p.decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("json: line %d: unexpected data after top-level value", p.line(p.offset()))
+	}
+	return root, nil
+}
+
+type jsonNodeParser struct {
+	in      []byte
+	decoder *json.Decoder
+}
+
+func (p *jsonNodeParser) parseValue() (*yaml.Node, error) {
+	start := p.offset()
+	tok, err := p.decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &yaml.Node{Line: p.line(start), Column: p.column(start)}
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '{' {
+			return p.parseObject(n)
+		}
+		return p.parseArray(n)
+	case json.Number:
+		// Tag numbers the way YAML resolves them, so integers beyond 64
+		// bits keep their literal without an explicit tag in YAML output.
+		n.Kind, n.Value = yaml.ScalarNode, v.String()
+		n.Tag = n.ShortTag()
+	case string:
+		n.Kind, n.Tag, n.Value = yaml.ScalarNode, "!!str", v
+	case bool:
+		n.Kind, n.Tag, n.Value = yaml.ScalarNode, "!!bool", strconv.FormatBool(v)
+	case nil:
+		n.Kind, n.Tag, n.Value = yaml.ScalarNode, "!!null", "null"
+	}
+	return n, nil
+}
+
+func (p *jsonNodeParser) parseObject(n *yaml.Node) (*yaml.Node, error) {
+	n.Kind, n.Tag = yaml.MappingNode, "!!map"
+	for p.decoder.More() {
+		start := p.offset()
+		tok, err := p.decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		if mappingIndex(n, key) >= 0 {
+			return nil, fmt.Errorf("json: line %d: duplicate key %q", p.line(start), key)
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		keyNode := newStringNode(key)
+		keyNode.Line, keyNode.Column = p.line(start), p.column(start)
+		n.Content = append(n.Content, keyNode, value)
+	}
+	_, err := p.decoder.Token()
+	return n, err
+}
+
+func (p *jsonNodeParser) parseArray(n *yaml.Node) (*yaml.Node, error) {
+	n.Kind, n.Tag = yaml.SequenceNode, "!!seq"
+	for p.decoder.More() {
+		item, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		n.Content = append(n.Content, item)
+	}
+	_, err := p.decoder.Token()
+	return n, err
+}
+
+// offset returns the offset of the next token, skipping the whitespace and
+// separators the decoder has not consumed yet.
+func (p *jsonNodeParser) offset() int {
+	offset := int(p.decoder.InputOffset())
+	for offset < len(p.in) && strings.IndexByte(" \t\r\n,:", p.in[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func (p *jsonNodeParser) line(offset int) int {
+	return bytes.Count(p.in[:offset], []byte("\n")) + 1
+}
+
+func (p *jsonNodeParser) column(offset int) int {
+	return offset - bytes.LastIndexByte(p.in[:offset], '\n')
+}
+
+func (p *jsonNodeParser) wrapError(err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("json: line %d: %s", p.line(int(syntaxErr.Offset)), syntaxErr.Error())
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return fmt.Errorf("json: line %d: unexpected end of input", p.line(len(p.in)))
+	}
+	return err
+}
+
+// decodeTOMLNode parses a TOML document into a node tree.  Keys keep the
+// order of the document; TOML carries no positions, so nodes have none.
+func decodeTOMLNode(in []byte) (*yaml.Node, error) {
+	var data map[string]any
+	md, err := toml.Decode(string(in), &data)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("toml: line %d: %s", parseErr.Position.Line, parseErr.Message)
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	order := make(map[string]int)
+	for i, key := range md.Keys() {
+		path := strings.Join(key, "\x00")
+		if _, ok := order[path]; !ok {
+			order[path] = i
+		}
+	}
+	return tomlValueNode(data, nil, order), nil
+}
+
+func tomlValueNode(v any, path []string, order map[string]int) *yaml.Node {
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			return tomlKeyOrder(path, keys[i], order) < tomlKeyOrder(path, keys[j], order)
+		})
+
+		n := newMappingNode()
+		for _, key := range keys {
+			childPath := append(append([]string{}, path...), key)
+			n.Content = append(n.Content, newStringNode(key), tomlValueNode(v[key], childPath, order))
+		}
+		return n
+	case []map[string]any:
+		items := make([]*yaml.Node, 0, len(v))
+		for _, item := range v {
+			items = append(items, tomlValueNode(item, path, order))
+		}
+		return newSequenceNode(items)
+	case []any:
+		items := make([]*yaml.Node, 0, len(v))
+		for _, item := range v {
+			items = append(items, tomlValueNode(item, path, order))
+		}
+		return newSequenceNode(items)
+	case string:
+		return newStringNode(v)
+	case int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(v, 10)}
+	case float64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: formatTOMLFloat(v)}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}
+	case time.Time:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!timestamp", Value: v.Format(time.RFC3339Nano)}
+	default:
+		return newStringNode(fmt.Sprint(v))
+	}
+}
+
+// tomlKeyOrder returns the position of key below path in the document;
+// array indexes do not appear in TOML key paths.
+func tomlKeyOrder(path []string, key string, order map[string]int) int {
+	i, ok := order[strings.Join(append(append([]string{}, path...), key), "\x00")]
+	if !ok {
+		return len(order)
+	}
+	return i
+}
+
+func formatTOMLFloat(f float64) string {
+	var n yaml.Node
+	_ = n.Encode(f)
+	return n.Value
+}
+
+// splitOperatorsDocument splits a single JSON or TOML layer document with
+// a top-level operators key into a metadata document holding the operators,
+// profiles, tags and when clause and a data document holding the other keys.
+func splitOperatorsDocument(doc *yaml.Node) []*yaml.Node {
+	root := doc.Content[0]
+	if !isMappingNode(root) {
+		return []*yaml.Node{doc}
+	}
+	i := mappingIndex(root, "operators")
+	if i < 0 || !looksLikeOperatorMetadata(root.Content[i+1]) {
+		return []*yaml.Node{doc}
+	}
+
+	meta := newMappingNode()
+	data := withContent(root, make([]*yaml.Node, 0, len(root.Content)))
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if isLayerMetadataKey(root.Content[i].Value) {
+			meta.Content = append(meta.Content, root.Content[i], root.Content[i+1])
+		} else {
+			data.Content = append(data.Content, root.Content[i], root.Content[i+1])
+		}
+	}
+	return []*yaml.Node{newDocumentNode(meta), newDocumentNode(data)}
+}
@@ -0,0 +1,188 @@
+package compose
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const jsonOutputIndent = "  "
+
+// MarshalJSON is a MarshalFunc rendering indented JSON.  Keys keep the
+// document order, integers keep their full precision and non-string keys
+// are written as their YAML text.
+func MarshalJSON(in any) ([]byte, error) {
+	compact, err := MarshalJSONCompact(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, bytes.TrimSuffix(compact, []byte("\n")), "", jsonOutputIndent); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// MarshalJSONCompact is MarshalJSON without indentation.
+func MarshalJSONCompact(in any) ([]byte, error) {
+	n, err := toYAMLNode(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := writeJSONNode(&out, n, ""); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// toYAMLNode returns in as a node, encoding values that are not nodes yet.
+func toYAMLNode(in any) (*yaml.Node, error) {
+	if n, ok := in.(*yaml.Node); ok {
+		return n, nil
+	}
+
+	var n yaml.Node
+	if err := n.Encode(in); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func writeJSONNode(out *bytes.Buffer, n *yaml.Node, path string) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			out.WriteString("null")
+			return nil
+		}
+		return writeJSONNode(out, n.Content[0], path)
+	case yaml.AliasNode:
+		return writeJSONNode(out, n.Alias, path)
+	case yaml.MappingNode:
+		return writeJSONObject(out, n, path)
+	case yaml.SequenceNode:
+		out.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeJSONNode(out, item, joinPathIndex(path, i)); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+		return nil
+	default:
+		return writeJSONScalar(out, n, path)
+	}
+}
+
+func writeJSONObject(out *bytes.Buffer, n *yaml.Node, path string) error {
+	seen := make(map[string]bool, len(n.Content)/2)
+	out.WriteByte('{')
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key := jsonObjectKey(n.Content[i])
+		if seen[key] {
+			return fmt.Errorf("cannot convert %s to JSON: duplicate key %q", jsonPathName(path), key)
+		}
+		seen[key] = true
+
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		writeJSONString(out, key)
+		out.WriteByte(':')
+		if err := writeJSONNode(out, n.Content[i+1], joinPathKey(path, key)); err != nil {
+			return err
+		}
+	}
+	out.WriteByte('}')
+	return nil
+}
+
+// jsonObjectKey renders a mapping key as a JSON object key.  yaml.v3 accepts
+// any node as a key, so numbers, booleans, null and even collections are
+// written as their YAML text.
+func jsonObjectKey(key *yaml.Node) string {
+	if key.Kind == yaml.AliasNode {
+		key = key.Alias
+	}
+	if key.Kind != yaml.ScalarNode {
+		return renderInlineYAML(key)
+	}
+	if key.ShortTag() == "!!null" {
+		return "null"
+	}
+	return key.Value
+}
+
+// jsonNumberPattern matches number literals that are valid JSON as written.
+var jsonNumberPattern = regexp.MustCompile(`^-?(?:0|[1-9][0-9]*)(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?$`)
+
+func writeJSONScalar(out *bytes.Buffer, n *yaml.Node, path string) error {
+	switch n.ShortTag() {
+	case "!!null":
+		out.WriteString("null")
+	case "!!bool":
+		var b bool
+		if err := n.Decode(&b); err != nil {
+			return fmt.Errorf("cannot convert %s to JSON: %w", jsonPathName(path), err)
+		}
+		out.WriteString(strconv.FormatBool(b))
+	case "!!int":
+		if jsonNumberPattern.MatchString(n.Value) {
+			out.WriteString(n.Value)
+			return nil
+		}
+		var i big.Int
+		if _, ok := i.SetString(strings.ReplaceAll(n.Value, "_", ""), 0); !ok {
+			return fmt.Errorf("cannot convert %s to JSON: invalid integer %q", jsonPathName(path), n.Value)
+		}
+		out.WriteString(i.String())
+	case "!!float":
+		if jsonNumberPattern.MatchString(n.Value) {
+			out.WriteString(n.Value)
+			return nil
+		}
+		var f float64
+		if err := n.Decode(&f); err != nil {
+			return fmt.Errorf("cannot convert %s to JSON: %w", jsonPathName(path), err)
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("cannot convert %s to JSON: %s has no JSON representation", jsonPathName(path), n.Value)
+		}
+		out.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	default:
+		writeJSONString(out, n.Value)
+	}
+	return nil
+}
+
+// writeJSONString writes s as a JSON string without escaping HTML
+// characters.
+func writeJSONString(out *bytes.Buffer, s string) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(s)
+	out.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+func jsonPathName(path string) string {
+	if path == "" {
+		return "document root"
+	}
+	return fmt.Sprintf("%q", path)
+}
@@ -5,75 +5,153 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
-// parseLayer reads a raw layer file (one or two YAML documents) and returns
-// the data map together with the list of operators to apply.
-func parseLayer(in []byte) (map[string]any, []layerTransform, error) {
-	docs, err := decodeYAMLDocuments(in)
+// parsedLayer is a parsed layer: its data mapping, the operators to apply,
+// the profiles and tags that activate it and its when clause.
+type parsedLayer struct {
+	data       *yaml.Node
+	operators  []layerTransform
+	activation layerActivation
+	when       *whenExpr
+}
+
+// parseLayerDocuments reads a raw layer file (one or two YAML documents, or
+// one JSON or TOML document as told by format) and returns the data mapping
+// together with the list of operators to apply.  Every error is a
+// *LayerParseError positioned at the offending node when known; the
+// operators that could be built are returned even when others failed.
+func parseLayerDocuments(format string, in []byte) (parsedLayer, []error) {
+	docs, err := decodeDocuments(format, in)
 	if err != nil {
-		return nil, nil, err
+		return parsedLayer{}, []error{newLayerParseError(err)}
+	}
+	return layerFromDocuments(format, docs)
+}
+
+// layerFromDocuments splits decoded layer documents into the data mapping
+// and the operators to apply, like parseLayerDocuments.
+func layerFromDocuments(format string, docs []*yaml.Node) (parsedLayer, []error) {
+	if format != fileFormatYAML && len(docs) == 1 {
+		docs = splitOperatorsDocument(docs[0])
 	}
 
 	switch len(docs) {
 	case 0:
-		return map[string]any{}, []layerTransform{defaultMergeOperator()}, nil
+		return parsedLayer{data: newMappingNode(), operators: []layerTransform{defaultMergeOperator()}}, nil
 	case 1:
-		data, err := decodeYAMLMap(docs[0])
+		data, err := documentMapping(docs[0])
 		if err != nil {
-			return nil, nil, err
-		}
-
-		if rawOperators, hasOperators := data["operators"]; hasOperators && looksLikeOperatorMetadata(rawOperators) {
-			if len(data) == 1 {
-				meta, err := decodeLayerMetadata(docs[0])
-				if err != nil {
-					return nil, nil, err
-				}
-				operators, err := buildLayerOperators(meta)
-				if err != nil {
-					return nil, nil, err
-				}
-				return map[string]any{}, operators, nil
+			return parsedLayer{}, []error{parseErrorAt(docs[0].Content[0], err)}
+		}
+
+		if rawOperators, hasOperators := mappingValue(data, "operators"); hasOperators && looksLikeOperatorMetadata(rawOperators) {
+			if onlyLayerMetadataKeys(data) {
+				layer, errs := parseLayerMetadata(docs[0])
+				layer.data = newMappingNode()
+				return layer, errs
 			}
 
-			return nil, nil, fmt.Errorf("layer with operators metadata must use two YAML documents separated by ---")
+			err := fmt.Errorf("layer with operators metadata must use two YAML documents separated by ---")
+			return parsedLayer{}, []error{parseErrorAt(data.Content[mappingIndex(data, "operators")], err)}
 		}
 
-		return data, []layerTransform{defaultMergeOperator()}, nil
+		return parsedLayer{data: data, operators: []layerTransform{defaultMergeOperator()}}, checkMergeDirectives(data)
 	case 2:
-		meta, err := decodeLayerMetadata(docs[0])
-		if err != nil {
-			return nil, nil, err
-		}
-		operators, err := buildLayerOperators(meta)
+		layer, errs := parseLayerMetadata(docs[0])
+		data, err := documentMapping(docs[1])
 		if err != nil {
-			return nil, nil, err
+			errs = append(errs, parseErrorAt(docs[1].Content[0], err))
+		} else {
+			errs = append(errs, checkMergeDirectives(data)...)
 		}
-		data, err := decodeYAMLMap(docs[1])
-		if err != nil {
-			return nil, nil, err
+		if len(errs) > 0 {
+			return layer, errs
 		}
-		return data, operators, nil
+		layer.data = data
+		return layer, nil
 	default:
-		return nil, nil, fmt.Errorf("expected at most two YAML documents (metadata and data), got %d", len(docs))
+		err := fmt.Errorf("expected at most two YAML documents (metadata and data), got %d", len(docs))
+		return parsedLayer{}, []error{parseErrorAt(docs[2].Content[0], err)}
 	}
 }
 
-func looksLikeOperatorMetadata(raw any) bool {
-	ops, ok := raw.([]any)
-	if !ok || len(ops) == 0 {
+// parseLayerMetadata decodes the metadata document and builds its operators.
+// The returned layer has no data yet.
+func parseLayerMetadata(doc *yaml.Node) (parsedLayer, []error) {
+	meta, err := decodeLayerMetadata(doc)
+	if err != nil {
+		return parsedLayer{}, []error{newLayerParseError(err)}
+	}
+
+	when, err := parseWhen(meta.When)
+	if err != nil {
+		err = parseErrorAt(doc.Content[0].Content[mappingIndex(doc.Content[0], "when")+1], fmt.Errorf("invalid when %q: %w", meta.When, err))
+		return parsedLayer{}, []error{err}
+	}
+
+	operators, errs := buildLayerOperators(meta, doc)
+	for i, err := range errs {
+		errs[i] = newLayerParseError(err)
+	}
+	return parsedLayer{operators: operators, activation: meta.activation(), when: when}, errs
+}
+
+// newLayerParseError turns err into a *LayerParseError, taking the position
+// from a nested OperatorConfigError or from the YAML error message.
+func newLayerParseError(err error) *LayerParseError {
+	var parseErr *LayerParseError
+	if errors.As(err, &parseErr) {
+		return parseErr
+	}
+
+	var configErr *OperatorConfigError
+	if errors.As(err, &configErr) {
+		return &LayerParseError{Line: configErr.Line, Column: configErr.Column, Err: err}
+	}
+
+	return &LayerParseError{Line: syntaxErrorLine(err), Err: err}
+}
+
+func parseErrorAt(n *yaml.Node, err error) *LayerParseError {
+	return &LayerParseError{Line: n.Line, Column: n.Column, Err: err}
+}
+
+// isLayerMetadataKey reports whether key belongs in the metadata document of
+// a layer.
+func isLayerMetadataKey(key string) bool {
+	switch key {
+	case "operators", "profiles", "tags", "when":
+		return true
+	default:
 		return false
 	}
+}
 
-	for _, op := range ops {
-		m, ok := op.(map[string]any)
-		if !ok {
+func onlyLayerMetadataKeys(m *yaml.Node) bool {
+	for i := 0; i < len(m.Content); i += 2 {
+		if !isLayerMetadataKey(m.Content[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func looksLikeOperatorMetadata(raw *yaml.Node) bool {
+	if !isSequenceNode(raw) || len(raw.Content) == 0 {
+		return false
+	}
+
+	for _, op := range raw.Content {
+		if !isMappingNode(op) {
 			return false
 		}
-		kind, ok := m["kind"].(string)
+		rawKind, _ := mappingValue(op, "kind")
+		kind, ok := stringValue(rawKind)
 		if !ok || kind == "" {
 			return false
 		}
@@ -88,29 +166,46 @@ func defaultMergeOperator() layerTransform {
 	return layerTransform{
 		kind:       transformKindMerge,
 		sourceFrom: transformSourceLayer,
-		merge: layerMergeStrategy{
-			defaults: defaultMergeStrategy,
-			paths:    map[string]mergeStrategy{},
-		},
+		merge:      layerMergeStrategy{defaults: defaultMergeStrategy},
+		implicit:   true,
 	}
 }
 
 // buildLayerOperators converts the operator metadata slice into runtime
 // layerTransform values.  A default merge operator is appended automatically
-// when none of the declared operators is of kind "merge".
-func buildLayerOperators(meta layerMetadata) ([]layerTransform, error) {
+// when none of the declared operators is of kind "merge".  doc is the
+// metadata document the operators were decoded from and supplies positions.
+// Every operator is built; one *OperatorConfigError is returned per invalid
+// operator alongside the operators that were valid.
+func buildLayerOperators(meta layerMetadata, doc *yaml.Node) ([]layerTransform, []error) {
 	if len(meta.Operators) == 0 {
 		return []layerTransform{defaultMergeOperator()}, nil
 	}
 
+	opNodes := operatorNodes(doc)
 	operators := make([]layerTransform, 0, len(meta.Operators))
+	errs := make([]error, 0)
 	hasMerge := false
 	for i, opMeta := range meta.Operators {
 		fieldPrefix := fmt.Sprintf("operators[%d]", i)
+		var opNode *yaml.Node
+		if i < len(opNodes) {
+			opNode = opNodes[i]
+		}
+
 		op, err := buildLayerOperator(opMeta, fieldPrefix)
+		if err == nil {
+			op.when, err = parseWhen(opMeta.When)
+			if err != nil {
+				err = fieldError(fieldPrefix+".when", fmt.Errorf("invalid %s.when %q: %w", fieldPrefix, opMeta.When, err))
+			}
+		}
 		if err != nil {
-			return nil, err
+			errs = append(errs, newOperatorConfigError(i, fieldPrefix, opNode, err))
+			continue
 		}
+		op.index = i
+		op.node = opNode
 		if op.kind == transformKindMerge {
 			hasMerge = true
 		}
@@ -120,7 +215,7 @@ func buildLayerOperators(meta layerMetadata) ([]layerTransform, error) {
 		operators = append(operators, defaultMergeOperator())
 	}
 
-	return operators, nil
+	return operators, errs
 }
 
 func decodeYAMLDocuments(in []byte) ([]*yaml.Node, error) {
@@ -138,22 +233,12 @@ func decodeYAMLDocuments(in []byte) ([]*yaml.Node, error) {
 		if len(doc.Content) == 0 {
 			continue
 		}
+		resolveAliases(&doc)
 		docs = append(docs, &doc)
 	}
 	return docs, nil
 }
 
-func decodeYAMLMap(doc *yaml.Node) (map[string]any, error) {
-	var m map[string]any
-	if err := doc.Decode(&m); err != nil {
-		return nil, fmt.Errorf("expected YAML mapping document: %w", err)
-	}
-	if m == nil {
-		return map[string]any{}, nil
-	}
-	return m, nil
-}
-
 func decodeLayerMetadata(doc *yaml.Node) (layerMetadata, error) {
 	var raw map[string]any
 	if err := doc.Decode(&raw); err != nil {
@@ -163,7 +248,8 @@ func decodeLayerMetadata(doc *yaml.Node) (layerMetadata, error) {
 	forbidden := []string{"merge", "transform", "transforms"}
 	for _, key := range forbidden {
 		if _, ok := raw[key]; ok {
-			return layerMetadata{}, fmt.Errorf("legacy metadata field %q is not supported; use operators", key)
+			err := fmt.Errorf("legacy metadata field %q is not supported; use operators", key)
+			return layerMetadata{}, parseErrorAt(doc.Content[0].Content[mappingIndex(doc.Content[0], key)], err)
 		}
 	}
 
@@ -173,3 +259,64 @@ func decodeLayerMetadata(doc *yaml.Node) (layerMetadata, error) {
 	}
 	return meta, nil
 }
+
+// operatorNodes returns the mapping nodes of the operators list in a
+// metadata document.
+func operatorNodes(doc *yaml.Node) []*yaml.Node {
+	if doc == nil || len(doc.Content) == 0 {
+		return nil
+	}
+	rawOperators, ok := mappingValue(doc.Content[0], "operators")
+	if !ok || !isSequenceNode(rawOperators) {
+		return nil
+	}
+	return rawOperators.Content
+}
+
+// newOperatorConfigError completes the OperatorConfigError in err, or wraps
+// err in one, with the operator index and the position of the field below
+// opNode.
+func newOperatorConfigError(index int, fieldPrefix string, opNode *yaml.Node, err error) *OperatorConfigError {
+	var configErr *OperatorConfigError
+	if !errors.As(err, &configErr) {
+		configErr = &OperatorConfigError{Field: fieldPrefix, Err: err}
+	}
+	configErr.Operator = index
+
+	if opNode != nil {
+		field := strings.TrimPrefix(strings.TrimPrefix(configErr.Field, fieldPrefix), ".")
+		n := fieldNode(opNode, field)
+		configErr.Line, configErr.Column = n.Line, n.Column
+	}
+	return configErr
+}
+
+// fieldNode returns the node of a metadata field such as "source.path" or
+// "list_filter.include[1]" below n.  When the field is missing, the closest
+// enclosing node is returned.
+func fieldNode(n *yaml.Node, field string) *yaml.Node {
+	if field == "" {
+		return n
+	}
+
+	for _, segment := range strings.Split(field, ".") {
+		key, indexes, _ := strings.Cut(segment, "[")
+		child, ok := mappingValue(n, key)
+		if !ok {
+			return n
+		}
+		n = child
+
+		if indexes == "" {
+			continue
+		}
+		for _, raw := range strings.Split(strings.TrimSuffix(indexes, "]"), "][") {
+			index, err := strconv.Atoi(raw)
+			if err != nil || !isSequenceNode(n) || index < 0 || index >= len(n.Content) {
+				return n
+			}
+			n = n.Content[index]
+		}
+	}
+	return n
+}
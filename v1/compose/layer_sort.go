@@ -2,55 +2,65 @@ package compose
 
 import (
 	"fmt"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
 // NewLayerComparator returns a sort.SliceStable-compatible comparator that
 // orders layer filenames by their numeric prefix, then lexicographically by
-// name when the prefix is equal.
+// name when the prefix is equal.  Layers in subdirectories, such as
+// "prod/20-db.yaml", are ordered by their filename.
 func NewLayerComparator(layers []string) func(i, j int) bool {
 	return func(i, j int) bool {
-		ap, aname := part(layers[i])
-		bp, bname := part(layers[j])
-
-		api, aerr := strconv.Atoi(ap)
-		bpi, berr := strconv.Atoi(bp)
-		if aerr == nil && berr == nil {
-			if api != bpi {
-				return api < bpi
-			}
-			return strings.Compare(aname, bname) < 0
-		}
+		return layerLess(layers[i], layers[j])
+	}
+}
 
-		if aerr == nil {
-			return true
-		}
-		if berr == nil {
-			return false
-		}
+// layerLess reports whether layer a is applied before layer b.
+func layerLess(a string, b string) bool {
+	ap, aname := part(a)
+	bp, bname := part(b)
 
-		if ap != bp {
-			return strings.Compare(ap, bp) < 0
+	api, aerr := strconv.Atoi(ap)
+	bpi, berr := strconv.Atoi(bp)
+	if aerr == nil && berr == nil {
+		if api != bpi {
+			return api < bpi
 		}
 		return strings.Compare(aname, bname) < 0
 	}
+
+	if aerr == nil {
+		return true
+	}
+	if berr == nil {
+		return false
+	}
+
+	if ap != bp {
+		return strings.Compare(ap, bp) < 0
+	}
+	return strings.Compare(aname, bname) < 0
 }
 
 // part splits a layer filename at the first "-" and returns (prefix, rest).
-// If there is no "-", the entire string is returned as prefix with an empty rest.
+// If there is no "-", the entire filename is returned as prefix with an empty
+// rest.  The directory of a layer path is ignored.
 func part(s string) (string, string) {
-	left, right, ok := strings.Cut(s, "-")
+	name := filepath.Base(s)
+	left, right, ok := strings.Cut(name, "-")
 	if !ok {
-		return s, ""
+		return name, ""
 	}
 	return left, right
 }
 
 // validateLayerName returns an error when layer does not follow the required
-// "<numeric-order>-<name>" naming convention.
+// "<numeric-order>-<name>" naming convention.  The directory of a layer path
+// is ignored.
 func validateLayerName(layer string) error {
-	prefix, _, ok := strings.Cut(layer, "-")
+	prefix, _, ok := strings.Cut(filepath.Base(layer), "-")
 	if !ok || prefix == "" {
 		return fmt.Errorf("invalid layer file name %q: expected <order>-<name>.yaml", layer)
 	}
@@ -0,0 +1,283 @@
+package compose
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MemoryFile is a base or layer document supplied in memory instead of read
+// from the filesystem.
+type MemoryFile struct {
+	// Name identifies the document in messages, traces and provenance,
+	// where it appears as "memory:<Name>".
+	Name string
+	// Format is the format of Data: "yaml" (default), "json" or "toml".
+	Format string
+	// Data is the document as it would be stored in a file.  Layer data is
+	// rendered as a template like layer files.
+	Data []byte
+	// Value is used when Data is nil: a *yaml.Node or any value yaml.v3
+	// encodes, such as a map or a struct.  A layer Value keeps its operators
+	// under a top-level "operators" key, like JSON layers.
+	Value any
+}
+
+// MemoryLayer is a layer supplied in memory.
+type MemoryLayer struct {
+	// Order places the layer in the stack like the numeric prefix of a
+	// layer filename.  Layers with equal order are sorted by name.  Like a
+	// filename prefix it must not be negative.
+	Order int
+	MemoryFile
+}
+
+// SetMemoryBase makes every subsequent run start from base instead of
+// reading Base.  Base still locates relative source.file paths and the
+// default layer directory.  A nil base reads Base again.
+func (c *Compose) SetMemoryBase(base *MemoryFile) {
+	c.memoryBase = base
+}
+
+// AddMemoryLayer adds a layer to the stack.  It is sorted among the layer
+// files by its Order.
+func (c *Compose) AddMemoryLayer(layer MemoryLayer) {
+	c.memoryLayers = append(c.memoryLayers, layer)
+}
+
+// memoryPath is the path shown for a document supplied in memory.
+func memoryPath(name string) string {
+	return "memory:" + name
+}
+
+// format returns the format of Data, or JSON for a Value so a top-level
+// operators key is split off like in JSON layers.
+func (f *MemoryFile) format() (string, error) {
+	if f.Data == nil {
+		return fileFormatJSON, nil
+	}
+	switch f.Format {
+	case "", fileFormatYAML:
+		return fileFormatYAML, nil
+	case fileFormatJSON, fileFormatTOML:
+		return f.Format, nil
+	default:
+		return "", fmt.Errorf("unsupported format %q for %q: supported values: yaml, json, toml", f.Format, f.Name)
+	}
+}
+
+// valueDocuments encodes Value into a document, expanding aliases like
+// decoded files.  Nodes are copied so runs never modify the caller's value.
+func (f *MemoryFile) valueDocuments() ([]*yaml.Node, error) {
+	if f.Value == nil {
+		return nil, nil
+	}
+	n, err := toYAMLNode(f.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %q: %w", f.Name, err)
+	}
+	n = resolveAliases(cloneNode(n))
+	if n.Kind != yaml.DocumentNode {
+		n = newDocumentNode(n)
+	}
+	return []*yaml.Node{n}, nil
+}
+
+// layerSpec is one layer of the stack: a file in the layer directory or a
+// layer supplied in memory.
+type layerSpec struct {
+	// name is the layer name used in messages: the filename or the
+	// MemoryLayer name.
+	name string
+	// path is the file path, or memoryPath(name).
+	path string
+	// file is the layer filename relative to its layer directory; empty for
+	// memory layers.
+	file string
+	// dirIndex breaks ties between layers with the same order prefix: 0 for
+	// Layers and memory layers, i+1 for layers discovered in LayerDirs[i].
+	dirIndex int
+	memory   *MemoryLayer
+}
+
+// less orders layers by order, then by dirIndex, then by name.
+func (s layerSpec) less(other layerSpec) bool {
+	order, name := s.orderKey()
+	otherOrder, otherName := other.orderKey()
+	if order != otherOrder {
+		return order < otherOrder
+	}
+	if s.dirIndex != other.dirIndex {
+		return s.dirIndex < other.dirIndex
+	}
+	return name < otherName
+}
+
+// orderKey returns the order of the layer and the name it is sorted by
+// among layers of the same order: the Order and Name of a memory layer, the
+// order prefix and the rest of the filename of a layer file.
+func (s layerSpec) orderKey() (int, string) {
+	if s.memory != nil {
+		return s.memory.Order, s.memory.Name
+	}
+	prefix, rest := part(s.file)
+	order, _ := strconv.Atoi(prefix)
+	return order, rest
+}
+
+// layerStack returns the layers in the order they are applied: Layers, the
+// layers discovered in the layer directory of a NewFromFS Compose and in
+// LayerDirs and the memory layers, narrowed by the layer
+// selection.  Layers discovered in LayerDirs are named by their path so their
+// directory shows in messages and traces.  Layer files with invalid names are
+// reported and left out.
+func (c *Compose) layerStack() ([]layerSpec, []error) {
+	errs := make([]error, 0)
+	specs := make([]layerSpec, 0, len(c.Layers)+len(c.memoryLayers))
+	for _, layer := range c.Layers {
+		if err := validateLayerName(layer); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		specs = append(specs, layerSpec{name: layer, path: c.layerPath(layer), file: layer})
+	}
+	if c.discoverLayerDir {
+		discovered, discoverErrs := c.discoverLayerSpecs(c.layerDir(), 0)
+		specs, errs = append(specs, discovered...), append(errs, discoverErrs...)
+	}
+	for i, dir := range c.LayerDirs {
+		discovered, discoverErrs := c.discoverLayerSpecs(dir, i+1)
+		specs, errs = append(specs, discovered...), append(errs, discoverErrs...)
+	}
+	for i := range c.memoryLayers {
+		layer := &c.memoryLayers[i]
+		if layer.Order < 0 {
+			errs = append(errs, fmt.Errorf("invalid memory layer %q: order must not be negative, got %d", layer.Name, layer.Order))
+			continue
+		}
+		specs = append(specs, layerSpec{
+			name:   layer.Name,
+			path:   memoryPath(layer.Name),
+			memory: layer,
+		})
+	}
+
+	sort.SliceStable(specs, func(i, j int) bool {
+		return specs[i].less(specs[j])
+	})
+	specs, err := selectLayers(specs, c.selection)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return specs, errs
+}
+
+// discoverLayerSpecs discovers the layers of dir.  Layers of the layer
+// directory, dirIndex 0, are named by their filename like Layers; those of
+// LayerDirs by their path.
+func (c *Compose) discoverLayerSpecs(dir string, dirIndex int) ([]layerSpec, []error) {
+	layers, err := DiscoverLayers(c.fs.Fs, dir, c.discoverOptions())
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	specs := make([]layerSpec, 0, len(layers))
+	errs := make([]error, 0)
+	for _, layer := range layers {
+		if err := validateLayerName(layer); err != nil {
+			errs = append(errs, fmt.Errorf("%w in %q", err, dir))
+			continue
+		}
+		layerPath := filepath.Join(dir, layer)
+		name := layerPath
+		if dirIndex == 0 {
+			name = layer
+		}
+		specs = append(specs, layerSpec{name: name, path: layerPath, file: layer, dirIndex: dirIndex})
+	}
+	return specs, errs
+}
+
+// loadLayer reads, renders and parses a layer.  Like parseLayerDocuments it
+// returns the operators that could be built together with every problem;
+// errors do not know the layer yet.
+func (c *composeRun) loadLayer(spec layerSpec) (parsedLayer, []error) {
+	if spec.memory == nil {
+		in, err := c.fs.ReadFile(spec.path)
+		if err != nil {
+			return parsedLayer{}, []error{fmt.Errorf("failed to read layer compose file %q: %w", spec.path, err)}
+		}
+		c.recordFileRead(spec.path)
+
+		in, err = c.renderLayerTemplate(in, spec.name, spec.path)
+		if err != nil {
+			return parsedLayer{}, []error{err}
+		}
+		return parseLayerDocuments(fileFormat(spec.path), in)
+	}
+
+	format, err := spec.memory.format()
+	if err != nil {
+		return parsedLayer{}, []error{&LayerParseError{Err: err}}
+	}
+	if spec.memory.Data == nil {
+		docs, err := spec.memory.valueDocuments()
+		if err != nil {
+			return parsedLayer{}, []error{&LayerParseError{Err: err}}
+		}
+		return layerFromDocuments(format, docs)
+	}
+
+	in, err := c.renderLayerTemplate(spec.memory.Data, spec.name, spec.path)
+	if err != nil {
+		return parsedLayer{}, []error{err}
+	}
+	return parseLayerDocuments(format, in)
+}
+
+// basePath returns the path shown for the base: Base, or the memory path of
+// the base supplied in memory.
+func (c *Compose) basePath() string {
+	if c.memoryBase != nil {
+		return memoryPath(c.memoryBase.Name)
+	}
+	return c.Base
+}
+
+// loadBase reads and parses the base and returns the document together with
+// its root mapping.
+func (c *composeRun) loadBase() (*yaml.Node, *yaml.Node, error) {
+	if c.memoryBase == nil {
+		in, err := c.fs.ReadFile(c.Base)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read base compose file: %w", err)
+		}
+		c.recordFileRead(c.Base)
+
+		doc, root, err := parseBaseDocument(fileFormat(c.Base), in)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse base compose file: %w", err)
+		}
+		return doc, root, nil
+	}
+
+	var docs []*yaml.Node
+	format, err := c.memoryBase.format()
+	if err == nil && c.memoryBase.Data == nil {
+		docs, err = c.memoryBase.valueDocuments()
+	} else if err == nil {
+		docs, err = decodeDocuments(format, c.memoryBase.Data)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse base compose file %q: %w", c.basePath(), err)
+	}
+
+	doc, root, err := baseFromDocuments(docs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse base compose file %q: %w", c.basePath(), err)
+	}
+	return doc, root, nil
+}
@@ -1,79 +1,387 @@
 package compose
 
-import "fmt"
+import (
+	"fmt"
+	"reflect"
+	"strconv"
 
-// mergeMaps deep-merges layer into base using the default merge strategy.
-func mergeMaps(base map[string]any, layer map[string]any) map[string]any {
-	return mergeMapsWithStrategy(base, layer, layerMergeStrategy{defaults: defaultMergeStrategy}, nil)
+	"gopkg.in/yaml.v3"
+)
+
+// mergeMaps deep-merges layer into base using the default merge strategy,
+// which cannot fail.
+func mergeMaps(base *yaml.Node, layer *yaml.Node) *yaml.Node {
+	merged, _ := mergeMapsWithStrategy(base, layer, layerMergeStrategy{defaults: defaultMergeStrategy}, nil)
+	return merged
 }
 
-func mergeMapsWithStrategy(base map[string]any, layer map[string]any, strategy layerMergeStrategy, path []string) map[string]any {
+// mergeMapsWithStrategy merges the layer mapping into the base mapping in
+// place.  Existing keys keep their position in base; keys only present in
+// layer are appended in the order they appear there.
+func mergeMapsWithStrategy(base *yaml.Node, layer *yaml.Node, strategy layerMergeStrategy, path []string) (*yaml.Node, error) {
 	if base == nil {
-		base = map[string]any{}
+		base = newMappingNode()
 	}
 
-	for k, v := range layer {
-		existing, ok := base[k]
-		if !ok {
-			base[k] = v
+	switch strategy.resolve(path).Map {
+	case mapMergeKeep:
+		return mergeKeep(base, layer), nil
+	case mapMergeStrict:
+		return mergeStrict(base, layer, path)
+	case mapMergeReplaceKeys:
+		for i := 0; i+1 < len(layer.Content); i += 2 {
+			if isDeleteDirective(layer.Content[i+1]) {
+				if err := checkStrictDelete(base, layer.Content[i].Value, strategy, path); err != nil {
+					return nil, err
+				}
+				mergeDeleteKey(base, layer.Content[i].Value)
+				continue
+			}
+			mergeSetKey(base, layer.Content[i], layer.Content[i+1])
+		}
+		return base, nil
+	}
+
+	for i := 0; i+1 < len(layer.Content); i += 2 {
+		key, v := layer.Content[i], layer.Content[i+1]
+		if isDeleteDirective(v) {
+			if err := checkStrictDelete(base, key.Value, strategy, path); err != nil {
+				return nil, err
+			}
+			mergeDeleteKey(base, key.Value)
+			continue
+		}
+		index := mappingIndex(base, key.Value)
+		if index < 0 {
+			base.Content = append(base.Content, key, v)
 			continue
 		}
-		nextPath := appendPath(path, k)
-		base[k] = mergeValue(existing, v, strategy, nextPath)
+		existing := base.Content[index+1]
+		nextPath := appendPath(path, key.Value)
+		merged, err := mergeValue(existing, v, strategy, nextPath)
+		if err != nil {
+			return nil, err
+		}
+		carryComments(merged, existing)
+		base.Content[index+1] = merged
 	}
 
-	return base
+	return base, nil
+}
+
+// checkStrictDelete returns a *PathError when !delete would remove key from
+// base although the strategy of its path is strict.
+func checkStrictDelete(base *yaml.Node, key string, strategy layerMergeStrategy, path []string) error {
+	index := mappingIndex(base, key)
+	keyPath := appendPath(path, key)
+	if index < 0 || !isMappingNode(base.Content[index+1]) || strategy.resolve(keyPath).Map != mapMergeStrict {
+		return nil
+	}
+	err := fmt.Errorf("strict merge: cannot delete %q", normalizePath(keyPath))
+	return &PathError{Path: normalizePath(keyPath), Err: err}
 }
 
-func mergeValue(base any, layer any, strategy layerMergeStrategy, path []string) any {
-	baseMap, baseIsMap := base.(map[string]any)
-	layerMap, layerIsMap := layer.(map[string]any)
-	if baseIsMap && layerIsMap {
-		pathStrategy := strategy.resolve(path)
+// mergeValue merges the layer value into the base value at path.  An inline
+// directive on the layer value wins over the strategy resolved for path,
+// except that a strict mapping stays strict.
+func mergeValue(base *yaml.Node, layer *yaml.Node, strategy layerMergeStrategy, path []string) (*yaml.Node, error) {
+	pathStrategy := strategy.resolve(path)
+	directive, ok, err := parseMergeDirective(layer)
+	if err != nil {
+		return nil, &PathError{Path: normalizePath(path), Err: fmt.Errorf("invalid merge directive at %q: %w", normalizePath(path), err)}
+	}
+	if isMappingNode(base) && pathStrategy.Map == mapMergeStrict {
+		return mergeStrict(base, layer, path)
+	}
+	if ok {
+		if directive.tag == directiveKeep {
+			return mergeKeep(base, layer), nil
+		}
+		pathStrategy = directive.apply(pathStrategy)
+	}
+
+	if isMappingNode(base) && pathStrategy.Map == mapMergeKeep {
+		return mergeKeep(base, layer), nil
+	}
+
+	if isMappingNode(base) && isMappingNode(layer) {
 		if pathStrategy.Map == mapMergeOverride {
-			return layerMap
+			return layer, nil
 		}
-		return mergeMapsWithStrategy(baseMap, layerMap, strategy, path)
+		return mergeMapsWithStrategy(base, layer, strategy, path)
 	}
 
-	baseList, baseIsList := base.([]any)
-	layerList, layerIsList := layer.([]any)
-	if baseIsList && layerIsList {
-		switch strategy.resolve(path).List {
+	if isSequenceNode(base) && isSequenceNode(layer) {
+		switch pathStrategy.List {
 		case listMergeAppend:
-			out := make([]any, 0, len(baseList)+len(layerList))
-			out = append(out, baseList...)
-			out = append(out, layerList...)
-			return out
+			out := make([]*yaml.Node, 0, len(base.Content)+len(layer.Content))
+			out = append(out, base.Content...)
+			out = append(out, layer.Content...)
+			return withContent(base, out), nil
 		case listMergePrepend:
-			out := make([]any, 0, len(baseList)+len(layerList))
-			out = append(out, layerList...)
-			out = append(out, baseList...)
-			return out
+			out := make([]*yaml.Node, 0, len(base.Content)+len(layer.Content))
+			out = append(out, layer.Content...)
+			out = append(out, base.Content...)
+			return withContent(base, out), nil
+		case listMergeByKey:
+			return mergeListByKey(base, layer, strategy, path, pathStrategy.Key)
+		case listMergeUnion, listMergeIntersect, listMergeSubtract:
+			return mergeListAsSet(base, layer, pathStrategy.List, path)
 		default:
-			return layerList
+			return layer, nil
+		}
+	}
+
+	return layer, nil
+}
+
+// mergeKeep adds the keys of layer missing in base, recursively, and keeps
+// every value base already has.
+func mergeKeep(base *yaml.Node, layer *yaml.Node) *yaml.Node {
+	if !isMappingNode(base) || !isMappingNode(layer) {
+		return base
+	}
+	for i := 0; i+1 < len(layer.Content); i += 2 {
+		key, v := layer.Content[i], layer.Content[i+1]
+		index := mappingIndex(base, key.Value)
+		if index < 0 {
+			if !isDeleteDirective(v) {
+				base.Content = append(base.Content, key, v)
+			}
+			continue
+		}
+		base.Content[index+1] = mergeKeep(base.Content[index+1], v)
+	}
+	return base
+}
+
+// mergeStrict adds the keys of layer missing in base, recursively, and
+// returns a *PathError naming the first value layer would change.  Values
+// equal to the base value are accepted.  Inline directives cannot get around
+// it: !override and the list directives compare the whole value, !delete
+// fails and !keep keeps base.
+func mergeStrict(base *yaml.Node, layer *yaml.Node, path []string) (*yaml.Node, error) {
+	directive, ok, _ := parseMergeDirective(layer)
+	if ok && directive.tag == directiveKeep {
+		return mergeKeep(base, layer), nil
+	}
+	if isMappingNode(base) && isMappingNode(layer) && !ok {
+		for i := 0; i+1 < len(layer.Content); i += 2 {
+			key, v := layer.Content[i], layer.Content[i+1]
+			index := mappingIndex(base, key.Value)
+			if index < 0 {
+				if !isDeleteDirective(v) {
+					base.Content = append(base.Content, key, v)
+				}
+				continue
+			}
+			if isDeleteDirective(v) {
+				err := fmt.Errorf("strict merge: cannot delete %q", normalizePath(appendPath(path, key.Value)))
+				return nil, &PathError{Path: normalizePath(appendPath(path, key.Value)), Err: err}
+			}
+			merged, err := mergeStrict(base.Content[index+1], v, appendPath(path, key.Value))
+			if err != nil {
+				return nil, err
+			}
+			base.Content[index+1] = merged
+		}
+		return base, nil
+	}
+
+	plain := stripMergeDirectives(cloneNode(layer))
+	baseValue, baseErr := decodeNodeValue(base)
+	layerValue, layerErr := decodeNodeValue(plain)
+	if baseErr == nil && layerErr == nil && reflect.DeepEqual(baseValue, layerValue) {
+		return base, nil
+	}
+	err := fmt.Errorf("strict merge: cannot change %q from %s to %s", normalizePath(path), renderInlineYAML(base), renderInlineYAML(plain))
+	return nil, &PathError{Path: normalizePath(path), Err: err}
+}
+
+// mergeSetKey sets key to value in the mapping m, keeping the position and
+// comments of an existing key.
+func mergeSetKey(m *yaml.Node, key *yaml.Node, value *yaml.Node) {
+	index := mappingIndex(m, key.Value)
+	if index < 0 {
+		m.Content = append(m.Content, key, value)
+		return
+	}
+	carryComments(value, m.Content[index+1])
+	m.Content[index+1] = value
+}
+
+// mergeDeleteKey removes key from the mapping m, if present.
+func mergeDeleteKey(m *yaml.Node, key string) {
+	if index := mappingIndex(m, key); index >= 0 {
+		m.Content = append(m.Content[:index], m.Content[index+2:]...)
+	}
+}
+
+// mergeListByKey merges the object items of layer into those of base with
+// the same key, like a Kubernetes strategic merge patch.  Matching items are
+// merged with the strategy of the item path, new items are appended and
+// base items keep their order.
+func mergeListByKey(base *yaml.Node, layer *yaml.Node, strategy layerMergeStrategy, path []string, keys [][]string) (*yaml.Node, error) {
+	out := make([]*yaml.Node, 0, len(base.Content)+len(layer.Content))
+	outKeys := make([][]*yaml.Node, 0, cap(out))
+	for i, item := range base.Content {
+		key, err := listItemKey(item, keys)
+		if err != nil {
+			return nil, &PathError{Path: normalizePath(path), Err: fmt.Errorf("cannot merge_by %q: base item %d: %w", normalizePath(path), i, err)}
+		}
+		out = append(out, item)
+		outKeys = append(outKeys, key)
+	}
+
+	for i, item := range layer.Content {
+		key, err := listItemKey(item, keys)
+		if err != nil {
+			return nil, &PathError{Path: normalizePath(path), Err: fmt.Errorf("cannot merge_by %q: layer item %d: %w", normalizePath(path), i, err)}
+		}
+
+		index := -1
+		for j, existing := range outKeys {
+			if listItemKeysEqual(existing, key) {
+				index = j
+				break
+			}
+		}
+		if index < 0 {
+			out = append(out, item)
+			outKeys = append(outKeys, key)
+			continue
+		}
+
+		merged, err := mergeValue(out[index], item, strategy, appendPath(path, listItemSegment(keys, key, index)))
+		if err != nil {
+			return nil, err
+		}
+		carryComments(merged, out[index])
+		out[index] = merged
+	}
+
+	return withContent(base, out), nil
+}
+
+// mergeListAsSet combines base and layer as sets of items compared by their
+// decoded values: union keeps the items of both lists, intersect the base
+// items also in layer and subtract the base items not in layer.  Items keep
+// the order they are first seen in; union and intersect drop duplicates.
+func mergeListAsSet(base *yaml.Node, layer *yaml.Node, list listMergeStrategy, path []string) (*yaml.Node, error) {
+	baseValues, err := decodeListItems(base, path)
+	if err != nil {
+		return nil, err
+	}
+	layerValues, err := decodeListItems(layer, path)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*yaml.Node, 0, len(base.Content)+len(layer.Content))
+	seen := make([]any, 0, cap(out))
+	keep := func(item *yaml.Node, value any) {
+		if !containsValue(seen, value) {
+			out = append(out, item)
+			seen = append(seen, value)
+		}
+	}
+	for i, item := range base.Content {
+		switch list {
+		case listMergeUnion:
+			keep(item, baseValues[i])
+		case listMergeIntersect:
+			if containsValue(layerValues, baseValues[i]) {
+				keep(item, baseValues[i])
+			}
+		case listMergeSubtract:
+			if !containsValue(layerValues, baseValues[i]) {
+				out = append(out, item)
+			}
+		}
+	}
+	if list == listMergeUnion {
+		for i, item := range layer.Content {
+			keep(item, layerValues[i])
 		}
 	}
 
-	return layer
+	return withContent(base, out), nil
+}
+
+func decodeListItems(list *yaml.Node, path []string) ([]any, error) {
+	values := make([]any, 0, len(list.Content))
+	for i, item := range list.Content {
+		value, err := decodeNodeValue(item)
+		if err != nil {
+			return nil, &PathError{Path: normalizePath(path), Err: fmt.Errorf("cannot compare item %d of %q: %w", i, normalizePath(path), err)}
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func containsValue(values []any, value any) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// listItemKey returns the values of the key fields of a merge_by item.
+func listItemKey(item *yaml.Node, keys [][]string) ([]*yaml.Node, error) {
+	if !isMappingNode(item) {
+		return nil, fmt.Errorf("expected object, got %s", nodeKindName(item))
+	}
+	values := make([]*yaml.Node, 0, len(keys))
+	for _, key := range keys {
+		value, ok := getValueAtPath(item, key)
+		if !ok {
+			return nil, fmt.Errorf("missing key %q", normalizePath(key))
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func listItemKeysEqual(a []*yaml.Node, b []*yaml.Node) bool {
+	for i := range a {
+		av, aerr := decodeNodeValue(a[i])
+		bv, berr := decodeNodeValue(b[i])
+		if aerr != nil || berr != nil || !reflect.DeepEqual(av, bv) {
+			return false
+		}
+	}
+	return true
+}
+
+// listItemSegment returns the path segment of a merged item: a selector
+// such as "name=api" for a single scalar key, so merge.paths rules like
+// "app.backends[name=api].ports" apply to the item, or its index otherwise.
+func listItemSegment(keys [][]string, key []*yaml.Node, index int) string {
+	if len(keys) == 1 && len(keys[0]) == 1 && key[0].Kind == yaml.ScalarNode {
+		return keys[0][0] + "=" + key[0].Value
+	}
+	return strconv.Itoa(index)
 }
 
 // buildLayerMergeStrategy converts the merge metadata from a layer operator
 // into the resolved layerMergeStrategy used at runtime.
 func buildLayerMergeStrategy(meta mergeMetadata) (layerMergeStrategy, error) {
-	strategy := layerMergeStrategy{
-		defaults: defaultMergeStrategy,
-		paths:    map[string]mergeStrategy{},
-	}
+	strategy := layerMergeStrategy{defaults: defaultMergeStrategy}
 
 	var err error
 	strategy.defaults, err = applyMetadataStrategy(strategy.defaults, meta.Defaults)
 	if err != nil {
 		return layerMergeStrategy{}, fmt.Errorf("invalid merge.defaults: %w", err)
 	}
+	if strategy.defaults.List == listMergeByKey {
+		return layerMergeStrategy{}, fmt.Errorf("invalid merge.defaults: list strategy %q is only supported in merge.paths", listMergeByKey)
+	}
 
 	for rawPath, override := range meta.Paths {
-		normalizedPath, err := normalizeDotPath(rawPath)
+		parts, err := splitMergePath(rawPath)
 		if err != nil {
 			return layerMergeStrategy{}, fmt.Errorf("invalid merge.paths.%q: %w", rawPath, err)
 		}
@@ -82,7 +390,12 @@ func buildLayerMergeStrategy(meta mergeMetadata) (layerMergeStrategy, error) {
 		if err != nil {
 			return layerMergeStrategy{}, fmt.Errorf("invalid merge.paths.%q: %w", rawPath, err)
 		}
-		strategy.paths[normalizedPath] = pathStrategy
+		if strategy.paths == nil {
+			strategy.paths = &mergePathTrie{}
+		}
+		if err := strategy.paths.insert(parts, pathStrategy); err != nil {
+			return layerMergeStrategy{}, fmt.Errorf("invalid merge.paths.%q: %w", rawPath, err)
+		}
 	}
 
 	return strategy, nil
@@ -106,12 +419,71 @@ func applyMetadataStrategy(base mergeStrategy, override mergeMetadataStrategy) (
 		ret.List = listStrategy
 	}
 
+	if override.Key != nil {
+		if ret.List != listMergeByKey {
+			return mergeStrategy{}, fmt.Errorf("key is only supported with list strategy %q", listMergeByKey)
+		}
+		keys, err := parseMergeKey(override.Key)
+		if err != nil {
+			return mergeStrategy{}, err
+		}
+		ret.Key = keys
+	}
+	if ret.List == listMergeByKey && len(ret.Key) == 0 {
+		return mergeStrategy{}, fmt.Errorf("list strategy %q requires key", listMergeByKey)
+	}
+
 	return ret, nil
 }
 
+// parseMergeKey parses the key of a merge_by strategy: one field path such
+// as "name", or a list of them for a composite key.
+func parseMergeKey(raw any) ([][]string, error) {
+	var rawKeys []any
+	switch key := raw.(type) {
+	case string:
+		rawKeys = []any{key}
+	case []any:
+		rawKeys = key
+	}
+	if len(rawKeys) == 0 {
+		return nil, fmt.Errorf("key must be a field path or a non-empty list of field paths")
+	}
+
+	keys := make([][]string, 0, len(rawKeys))
+	for _, rawKey := range rawKeys {
+		s, ok := rawKey.(string)
+		if !ok {
+			return nil, fmt.Errorf("key must be a field path or a non-empty list of field paths")
+		}
+		key, err := splitDotPath(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", s, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// splitMergePath splits a merge.paths key like splitDotPath and writes
+// selectors as key=value without quotes, the way merge_by names the items it
+// merges.
+func splitMergePath(path string) ([]string, error) {
+	parts, err := splitDotPath(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, part := range parts {
+		if key, value, ok := parsePathSelector(part); ok {
+			parts[i] = key + "=" + value
+		}
+	}
+	return parts, nil
+}
+
 func parseMapMergeStrategy(s string) (mapMergeStrategy, error) {
 	switch mapMergeStrategy(s) {
-	case mapMergeDeep, mapMergeOverride:
+	case mapMergeDeep, mapMergeOverride, mapMergeKeep, mapMergeStrict, mapMergeReplaceKeys:
 		return mapMergeStrategy(s), nil
 	default:
 		return "", fmt.Errorf("unsupported map strategy %q", s)
@@ -120,22 +492,22 @@ func parseMapMergeStrategy(s string) (mapMergeStrategy, error) {
 
 func parseListMergeStrategy(s string) (listMergeStrategy, error) {
 	switch listMergeStrategy(s) {
-	case listMergeOverride, listMergeAppend, listMergePrepend:
+	case listMergeOverride, listMergeAppend, listMergePrepend, listMergeByKey,
+		listMergeUnion, listMergeIntersect, listMergeSubtract:
 		return listMergeStrategy(s), nil
 	default:
 		return "", fmt.Errorf("unsupported list strategy %q", s)
 	}
 }
 
-// resolve returns the effective mergeStrategy for the given path, falling back
-// to the defaults when no path-specific override is registered.
+// resolve returns the effective mergeStrategy for the given path: the most
+// specific matching merge.paths rule, or the defaults when none matches.
 func (s layerMergeStrategy) resolve(path []string) mergeStrategy {
-	if len(s.paths) == 0 {
+	if s.paths == nil {
 		return s.defaults
 	}
-	normalizedPath := normalizePath(path)
-	if pathStrategy, ok := s.paths[normalizedPath]; ok {
-		return pathStrategy
+	if pathStrategy := s.paths.lookup(path); pathStrategy != nil {
+		return *pathStrategy
 	}
 	return s.defaults
 }
@@ -0,0 +1,171 @@
+package compose
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Inline merge directives are YAML tags on layer data values, such as
+// `ports: !append [5433]`.  A directive decides how its value is merged and
+// wins over merge.paths rules and defaults; values below it are merged as
+// usual.  Directives are removed from the composed output.
+const (
+	directiveAppend   = "!append"
+	directivePrepend  = "!prepend"
+	directiveOverride = "!override"
+	directiveDelete   = "!delete"
+	directiveKeep     = "!keep"
+	// directiveMergeBy takes the key after a colon, e.g. "!merge_by:name", or
+	// a comma-separated composite key, e.g. "!merge_by:host,path".
+	directiveMergeBy = "!merge_by"
+)
+
+// mergeDirective is a parsed inline merge directive.
+type mergeDirective struct {
+	tag string
+	// key is the merge_by key.
+	key [][]string
+}
+
+// parseMergeDirective returns the directive tagging n; ok is false when n
+// carries none.
+func parseMergeDirective(n *yaml.Node) (directive mergeDirective, ok bool, err error) {
+	if n == nil {
+		return mergeDirective{}, false, nil
+	}
+	switch n.Tag {
+	case directiveAppend, directivePrepend, directiveOverride, directiveDelete, directiveKeep:
+		return mergeDirective{tag: n.Tag}, true, nil
+	}
+
+	rest, found := strings.CutPrefix(n.Tag, directiveMergeBy)
+	if !found || (rest != "" && !strings.HasPrefix(rest, ":")) {
+		return mergeDirective{}, false, nil
+	}
+	rawKey := strings.TrimPrefix(rest, ":")
+	if rawKey == "" {
+		return mergeDirective{}, false, fmt.Errorf("%s requires a key, e.g. %s:name", directiveMergeBy, directiveMergeBy)
+	}
+	directive = mergeDirective{tag: directiveMergeBy}
+	for _, s := range strings.Split(rawKey, ",") {
+		key, err := splitDotPath(s)
+		if err != nil {
+			return mergeDirective{}, false, fmt.Errorf("invalid %s key %q: %w", directiveMergeBy, s, err)
+		}
+		directive.key = append(directive.key, key)
+	}
+	return directive, true, nil
+}
+
+// apply returns strategy as changed by the directive.
+func (d mergeDirective) apply(strategy mergeStrategy) mergeStrategy {
+	switch d.tag {
+	case directiveAppend:
+		strategy.List = listMergeAppend
+	case directivePrepend:
+		strategy.List = listMergePrepend
+	case directiveOverride:
+		strategy.Map, strategy.List = mapMergeOverride, listMergeOverride
+	case directiveKeep:
+		strategy.Map = mapMergeKeep
+	case directiveMergeBy:
+		strategy.List, strategy.Key = listMergeByKey, d.key
+	}
+	return strategy
+}
+
+func isDeleteDirective(n *yaml.Node) bool {
+	return n != nil && n.Tag == directiveDelete
+}
+
+// checkMergeDirectives reports the directives below the layer data mapping
+// that are malformed or tag a value they do not apply to.
+func checkMergeDirectives(data *yaml.Node) []error {
+	errs := make([]error, 0)
+	var walk func(n *yaml.Node, mappingValue bool)
+	walk = func(n *yaml.Node, mappingValue bool) {
+		directive, ok, err := parseMergeDirective(n)
+		switch {
+		case err != nil:
+			errs = append(errs, parseErrorAt(n, err))
+		case !ok:
+		case directive.tag == directiveDelete && !mappingValue:
+			errs = append(errs, parseErrorAt(n, fmt.Errorf("%s is only supported on mapping values", directiveDelete)))
+		case (directive.tag == directiveAppend || directive.tag == directivePrepend || directive.tag == directiveMergeBy) && n.Kind != yaml.SequenceNode:
+			untagged := *n
+			untagged.Tag = ""
+			errs = append(errs, parseErrorAt(n, fmt.Errorf("%s is only supported on lists, got %s", directive.tag, nodeKindName(&untagged))))
+		}
+
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 1; i < len(n.Content); i += 2 {
+				walk(n.Content[i], true)
+			}
+		case yaml.SequenceNode:
+			for _, child := range n.Content {
+				walk(child, false)
+			}
+		}
+	}
+	for i := 1; i < len(data.Content); i += 2 {
+		walk(data.Content[i], true)
+	}
+	return errs
+}
+
+// collectMergeDirectives returns the directives on the mapping values below
+// n by path, so they can still be told once stripMergeDirectives cleared
+// them.  Values inside lists are not collected.
+func collectMergeDirectives(n *yaml.Node) map[string]mergeDirective {
+	directives := map[string]mergeDirective{}
+	var walk func(n *yaml.Node, path []string)
+	walk = func(n *yaml.Node, path []string) {
+		if !isMappingNode(n) {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			value := n.Content[i+1]
+			valuePath := appendPath(path, n.Content[i].Value)
+			if directive, ok, err := parseMergeDirective(value); ok && err == nil {
+				directives[normalizePath(valuePath)] = directive
+			}
+			walk(value, valuePath)
+		}
+	}
+	walk(n, nil)
+	return directives
+}
+
+// stripMergeDirectives removes the directives below n once it is merged:
+// mapping entries tagged !delete are dropped and other directive tags are
+// cleared, leaving the tag the value would have without one.
+func stripMergeDirectives(n *yaml.Node) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	if _, ok, err := parseMergeDirective(n); ok || err != nil {
+		n.Tag = ""
+		n.Style &^= yaml.TaggedStyle
+		n.Tag = n.ShortTag()
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		content := n.Content[:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if isDeleteDirective(n.Content[i+1]) {
+				continue
+			}
+			content = append(content, n.Content[i], stripMergeDirectives(n.Content[i+1]))
+		}
+		n.Content = content
+	case yaml.SequenceNode:
+		for _, child := range n.Content {
+			stripMergeDirectives(child)
+		}
+	}
+	return n
+}
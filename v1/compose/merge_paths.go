@@ -0,0 +1,98 @@
+package compose
+
+import "fmt"
+
+const (
+	// mergePathWildcard is a merge.paths segment matching any one segment.
+	mergePathWildcard = "*"
+	// mergePathSubtree is a final merge.paths segment matching zero or more
+	// segments, so the rule covers the path and everything below it.
+	mergePathSubtree = "**"
+)
+
+// mergePathTrie holds the merge.paths rules of an operator, one segment per
+// level, so resolving a path walks it once instead of normalizing it.
+type mergePathTrie struct {
+	children map[string]*mergePathTrie
+	wildcard *mergePathTrie
+	// exact is the rule for the path ending here; subtree the rule for the
+	// path ending here followed by "**".
+	exact   *mergeStrategy
+	subtree *mergeStrategy
+}
+
+// insert adds the rule for the parsed path parts.
+func (t *mergePathTrie) insert(parts []string, strategy mergeStrategy) error {
+	node := t
+	for i, part := range parts {
+		switch part {
+		case mergePathSubtree:
+			if i != len(parts)-1 {
+				return fmt.Errorf("%q must be the last segment", mergePathSubtree)
+			}
+			node.subtree = &strategy
+			return nil
+		case mergePathWildcard:
+			if node.wildcard == nil {
+				node.wildcard = &mergePathTrie{}
+			}
+			node = node.wildcard
+		default:
+			if node.children == nil {
+				node.children = map[string]*mergePathTrie{}
+			}
+			child, ok := node.children[part]
+			if !ok {
+				child = &mergePathTrie{}
+				node.children[part] = child
+			}
+			node = child
+		}
+	}
+	node.exact = &strategy
+	return nil
+}
+
+// mergePathMatch is a rule matching a path, ranked by specificity.
+type mergePathMatch struct {
+	strategy *mergeStrategy
+	// literals counts the segments matched by name, depth those matched by
+	// name or "*".
+	literals int
+	depth    int
+}
+
+// lookup returns the most specific rule matching path, or nil.  The rule
+// matching the most segments by name wins; on a tie, the one matching more
+// segments before any "**", then the one whose names come first.
+func (t *mergePathTrie) lookup(path []string) *mergeStrategy {
+	var best mergePathMatch
+	t.collect(path, 0, 0, &best)
+	return best.strategy
+}
+
+// collect ranks the rules below t matching path.  Names are tried before
+// "*" and "*" before "**", so among equally specific rules the first found
+// has its names furthest left.
+func (t *mergePathTrie) collect(path []string, literals int, depth int, best *mergePathMatch) {
+	if len(path) == 0 && t.exact != nil {
+		best.consider(t.exact, literals, depth)
+	}
+	if len(path) > 0 {
+		if child, ok := t.children[path[0]]; ok {
+			child.collect(path[1:], literals+1, depth+1, best)
+		}
+		if t.wildcard != nil {
+			t.wildcard.collect(path[1:], literals, depth+1, best)
+		}
+	}
+	if t.subtree != nil {
+		best.consider(t.subtree, literals, depth)
+	}
+}
+
+func (m *mergePathMatch) consider(strategy *mergeStrategy, literals int, depth int) {
+	if m.strategy == nil || literals > m.literals || (literals == m.literals && depth > m.depth) {
+		*m = mergePathMatch{strategy: strategy, literals: literals, depth: depth}
+	}
+}
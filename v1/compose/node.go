@@ -0,0 +1,245 @@
+package compose
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// newMappingNode returns an empty block-style mapping node.
+func newMappingNode() *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+// newSequenceNode returns a block-style sequence node holding items.
+func newSequenceNode(items []*yaml.Node) *yaml.Node {
+	return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: items}
+}
+
+func newStringNode(s string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s}
+}
+
+func newDocumentNode(content *yaml.Node) *yaml.Node {
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{content}}
+}
+
+func isMappingNode(n *yaml.Node) bool {
+	return n != nil && n.Kind == yaml.MappingNode
+}
+
+func isSequenceNode(n *yaml.Node) bool {
+	return n != nil && n.Kind == yaml.SequenceNode
+}
+
+func isNullNode(n *yaml.Node) bool {
+	return n == nil || (n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null")
+}
+
+// stringValue returns the value of n when it is a string scalar.
+func stringValue(n *yaml.Node) (string, bool) {
+	if n == nil || n.Kind != yaml.ScalarNode || n.ShortTag() != "!!str" {
+		return "", false
+	}
+	return n.Value, true
+}
+
+// mappingIndex returns the index of the key node for key in the mapping m,
+// or -1 when the key is absent.  The value node lives at index+1.
+func mappingIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// mappingValue returns the value node stored under key in the mapping m.
+func mappingValue(m *yaml.Node, key string) (*yaml.Node, bool) {
+	i := mappingIndex(m, key)
+	if i < 0 {
+		return nil, false
+	}
+	return m.Content[i+1], true
+}
+
+// mappingSet replaces the value stored under key, appending a new pair at
+// the end of the mapping when the key is absent.
+func mappingSet(m *yaml.Node, key string, value *yaml.Node) {
+	if i := mappingIndex(m, key); i >= 0 {
+		m.Content[i+1] = value
+		return
+	}
+	m.Content = append(m.Content, newStringNode(key), value)
+}
+
+// cloneNode returns a deep copy of n.
+func cloneNode(n *yaml.Node) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	out := *n
+	if len(n.Content) > 0 {
+		out.Content = make([]*yaml.Node, len(n.Content))
+		for i, child := range n.Content {
+			out.Content[i] = cloneNode(child)
+		}
+	}
+	return &out
+}
+
+// withContent returns a shallow copy of n holding content, so style and
+// comments of the original collection survive.
+func withContent(n *yaml.Node, content []*yaml.Node) *yaml.Node {
+	out := *n
+	out.Content = content
+	return &out
+}
+
+// withScalarValue returns a copy of the scalar n holding value, keeping its
+// style and comments.
+func withScalarValue(n *yaml.Node, value string) *yaml.Node {
+	out := *n
+	out.Value = value
+	return &out
+}
+
+// carryComments copies comments from src to dst where dst has none, so a
+// value replaced by a layer keeps the commentary written next to it in the
+// base.
+func carryComments(dst *yaml.Node, src *yaml.Node) {
+	if dst == nil || src == nil || dst == src {
+		return
+	}
+	if dst.HeadComment == "" {
+		dst.HeadComment = src.HeadComment
+	}
+	if dst.LineComment == "" {
+		dst.LineComment = src.LineComment
+	}
+	if dst.FootComment == "" {
+		dst.FootComment = src.FootComment
+	}
+}
+
+// decodeNodeValue decodes n into plain Go values (map[string]any, []any and
+// scalars) for comparisons against operator metadata.
+func decodeNodeValue(n *yaml.Node) (any, error) {
+	if n == nil {
+		return nil, nil
+	}
+	var out any
+	if err := n.Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// nodeKindName describes n for error messages.
+func nodeKindName(n *yaml.Node) string {
+	if n == nil {
+		return "null"
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "object"
+	case yaml.SequenceNode:
+		return "list"
+	case yaml.ScalarNode:
+		return strings.TrimPrefix(n.ShortTag(), "!!")
+	default:
+		return fmt.Sprintf("node kind %d", n.Kind)
+	}
+}
+
+// documentMapping returns the root mapping of a YAML document node.  An empty
+// or null document yields an empty mapping.
+func documentMapping(doc *yaml.Node) (*yaml.Node, error) {
+	if doc == nil || len(doc.Content) == 0 {
+		return newMappingNode(), nil
+	}
+	root := doc.Content[0]
+	if isNullNode(root) {
+		return newMappingNode(), nil
+	}
+	if !isMappingNode(root) {
+		return nil, fmt.Errorf("expected YAML mapping document, got %s", nodeKindName(root))
+	}
+	return root, nil
+}
+
+// resolveAliases expands aliases and "<<" merge keys in place so every node
+// in the tree is owned by exactly one parent.  Anchors are dropped because
+// the expanded copies would otherwise redefine them.
+func resolveAliases(n *yaml.Node) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	if n.Kind == yaml.AliasNode {
+		expanded := resolveAliases(cloneNode(n.Alias))
+		carryComments(expanded, n)
+		return expanded
+	}
+
+	n.Anchor = ""
+	for i, child := range n.Content {
+		n.Content[i] = resolveAliases(child)
+	}
+	if n.Kind == yaml.MappingNode {
+		expandMergeKeys(n)
+	}
+	return n
+}
+
+// expandMergeKeys replaces "<<" entries of an alias-resolved mapping with
+// the keys they reference.  Explicit keys win over merged ones, and earlier
+// merge sources win over later ones, matching YAML merge key semantics.
+func expandMergeKeys(m *yaml.Node) {
+	hasMerge := false
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].ShortTag() == "!!merge" {
+			hasMerge = true
+			break
+		}
+	}
+	if !hasMerge {
+		return
+	}
+
+	explicit := map[string]bool{}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].ShortTag() != "!!merge" {
+			explicit[m.Content[i].Value] = true
+		}
+	}
+
+	content := make([]*yaml.Node, 0, len(m.Content))
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, value := m.Content[i], m.Content[i+1]
+		if key.ShortTag() != "!!merge" {
+			content = append(content, key, value)
+			continue
+		}
+
+		sources := []*yaml.Node{value}
+		if isSequenceNode(value) {
+			sources = value.Content
+		}
+		for _, source := range sources {
+			if !isMappingNode(source) {
+				continue
+			}
+			for j := 0; j+1 < len(source.Content); j += 2 {
+				name := source.Content[j].Value
+				if explicit[name] {
+					continue
+				}
+				explicit[name] = true
+				content = append(content, source.Content[j], source.Content[j+1])
+			}
+		}
+	}
+	m.Content = content
+}
@@ -26,7 +26,7 @@ type parsedOperatorTarget struct {
 
 func buildLayerOperator(meta layerOperatorMetadata, fieldPrefix string) (layerTransform, error) {
 	if meta.Kind == "" {
-		return layerTransform{}, fmt.Errorf("invalid %s.kind %q: cannot be empty", fieldPrefix, meta.Kind)
+		return layerTransform{}, fieldError(fieldPrefix+".kind", fmt.Errorf("invalid %s.kind %q: cannot be empty", fieldPrefix, meta.Kind))
 	}
 
 	if meta.Kind == transformKindMerge {
@@ -57,7 +57,7 @@ func buildMergeOperator(meta layerOperatorMetadata, fieldPrefix string) (layerTr
 
 	strategy, err := buildLayerMergeStrategy(meta.Merge)
 	if err != nil {
-		return layerTransform{}, fmt.Errorf("invalid %s.merge: %w", fieldPrefix, err)
+		return layerTransform{}, fieldError(fieldPrefix+".merge", fmt.Errorf("invalid %s.merge: %w", fieldPrefix, err))
 	}
 
 	op := layerTransform{
@@ -74,7 +74,7 @@ func buildMergeOperator(meta layerOperatorMetadata, fieldPrefix string) (layerTr
 
 func buildLayerTransform(meta layerTransformMetadata, fieldPrefix string) (layerTransform, error) {
 	if meta.Kind != transformKindListFilter && meta.Kind != transformKindListExtract && meta.Kind != transformKindListRemove && meta.Kind != transformKindReplaceVals {
-		return layerTransform{}, fmt.Errorf("invalid %s.kind %q: supported values: list_filter, list_extract, list_remove, replace_values", fieldPrefix, meta.Kind)
+		return layerTransform{}, fieldError(fieldPrefix+".kind", fmt.Errorf("invalid %s.kind %q: supported values: list_filter, list_extract, list_remove, replace_values", fieldPrefix, meta.Kind))
 	}
 
 	source, err := parseOperatorSource(meta.Source, fieldPrefix, transformSourceFile, sourcePathRequired)
@@ -136,7 +136,7 @@ func buildLayerTransform(meta layerTransformMetadata, fieldPrefix string) (layer
 
 func buildReplaceValues(meta layerReplaceValuesMetadata, fieldPrefix string) (layerReplaceValues, error) {
 	if meta.Old == "" {
-		return layerReplaceValues{}, fmt.Errorf("invalid %s.replace_values.old: cannot be empty", fieldPrefix)
+		return layerReplaceValues{}, fieldError(fieldPrefix+".replace_values.old", fmt.Errorf("invalid %s.replace_values.old: cannot be empty", fieldPrefix))
 	}
 
 	return layerReplaceValues{
@@ -150,7 +150,7 @@ func buildReplaceValues(meta layerReplaceValuesMetadata, fieldPrefix string) (la
 func buildListRemove(meta layerListRemoveMetadata, fieldPrefix string) (layerListRemove, error) {
 	matchPath, err := splitDotPath(meta.MatchPath)
 	if err != nil {
-		return layerListRemove{}, fmt.Errorf("invalid %s.list_remove.match_path %q: %w", fieldPrefix, meta.MatchPath, err)
+		return layerListRemove{}, fieldError(fieldPrefix+".list_remove.match_path", fmt.Errorf("invalid %s.list_remove.match_path %q: %w", fieldPrefix, meta.MatchPath, err))
 	}
 
 	predicate, predicateValue, err := parseListRemoveCondition(meta.When, fieldPrefix)
@@ -163,7 +163,7 @@ func buildListRemove(meta layerListRemoveMetadata, fieldPrefix string) (layerLis
 		removeMode = listRemoveMode(meta.Remove)
 	}
 	if removeMode != listRemoveAll && removeMode != listRemoveSingle {
-		return layerListRemove{}, fmt.Errorf("invalid %s.list_remove.remove %q: supported values: all, single", fieldPrefix, meta.Remove)
+		return layerListRemove{}, fieldError(fieldPrefix+".list_remove.remove", fmt.Errorf("invalid %s.list_remove.remove %q: supported values: all, single", fieldPrefix, meta.Remove))
 	}
 
 	return layerListRemove{matchPath: matchPath, remove: removeMode, predicate: predicate, value: predicateValue}, nil
@@ -200,10 +200,10 @@ func parseListRemoveCondition(meta layerListRemoveWhenMetadata, fieldPrefix stri
 	}
 
 	if configured == 0 {
-		return "", nil, fmt.Errorf("invalid %s.list_remove.when: set one of is_empty=true, equals, not_equals, has, has_not", fieldPrefix)
+		return "", nil, fieldError(fieldPrefix+".list_remove.when", fmt.Errorf("invalid %s.list_remove.when: set one of is_empty=true, equals, not_equals, has, has_not", fieldPrefix))
 	}
 	if configured > 1 {
-		return "", nil, fmt.Errorf("invalid %s.list_remove.when: only one condition is supported", fieldPrefix)
+		return "", nil, fieldError(fieldPrefix+".list_remove.when", fmt.Errorf("invalid %s.list_remove.when: only one condition is supported", fieldPrefix))
 	}
 
 	return predicate, value, nil
@@ -212,7 +212,7 @@ func parseListRemoveCondition(meta layerListRemoveWhenMetadata, fieldPrefix stri
 func buildListExtract(meta layerListExtractMetadata, fieldPrefix string) (layerListExtract, error) {
 	extractPath, err := splitDotPath(meta.ExtractPath)
 	if err != nil {
-		return layerListExtract{}, fmt.Errorf("invalid %s.list_extract.extract_path %q: %w", fieldPrefix, meta.ExtractPath, err)
+		return layerListExtract{}, fieldError(fieldPrefix+".list_extract.extract_path", fmt.Errorf("invalid %s.list_extract.extract_path %q: %w", fieldPrefix, meta.ExtractPath, err))
 	}
 
 	filterConfig, err := parseRegexFilterConfig(
@@ -270,14 +270,14 @@ func parseListFilterRewrite(meta layerListFilterRewriteMetadata, matchPath []str
 	}
 
 	if meta.Prefix == "" {
-		return nil, fmt.Errorf("invalid %s.list_filter.rewrite.prefix: cannot be empty when rewrite is configured", fieldPrefix)
+		return nil, fieldError(fieldPrefix+".list_filter.rewrite.prefix", fmt.Errorf("invalid %s.list_filter.rewrite.prefix: cannot be empty when rewrite is configured", fieldPrefix))
 	}
 
 	rewritePath := matchPath
 	if meta.Path != "" {
 		parsedPath, err := splitDotPath(meta.Path)
 		if err != nil {
-			return nil, fmt.Errorf("invalid %s.list_filter.rewrite.path %q: %w", fieldPrefix, meta.Path, err)
+			return nil, fieldError(fieldPrefix+".list_filter.rewrite.path", fmt.Errorf("invalid %s.list_filter.rewrite.path %q: %w", fieldPrefix, meta.Path, err))
 		}
 		rewritePath = parsedPath
 	}
@@ -315,7 +315,7 @@ func parseOptionalPath(rawPath string, fieldName string) ([]string, error) {
 
 	path, err := splitDotPath(rawPath)
 	if err != nil {
-		return nil, fmt.Errorf("invalid %s %q: %w", fieldName, rawPath, err)
+		return nil, fieldError(fieldName, fmt.Errorf("invalid %s %q: %w", fieldName, rawPath, err))
 	}
 
 	return path, nil
@@ -323,35 +323,35 @@ func parseOptionalPath(rawPath string, fieldName string) ([]string, error) {
 
 func parseOperatorTarget(meta layerTransformTarget, sourcePathRaw string, fieldPrefix string, supportsListStrategy bool, supportsIgnoreNotFound bool) (parsedOperatorTarget, error) {
 	hasLegacyList := meta.List != ""
-	hasMerge := meta.Merge.Defaults.Map != "" || meta.Merge.Defaults.List != "" || len(meta.Merge.Paths) > 0
+	hasMerge := meta.Merge.Defaults.Map != "" || meta.Merge.Defaults.List != "" || meta.Merge.Defaults.Key != nil || len(meta.Merge.Paths) > 0
 
 	if hasLegacyList && hasMerge {
-		return parsedOperatorTarget{}, fmt.Errorf("invalid %s.target: target.list and target.merge cannot be used together", fieldPrefix)
+		return parsedOperatorTarget{}, fieldError(fieldPrefix+".target", fmt.Errorf("invalid %s.target: target.list and target.merge cannot be used together", fieldPrefix))
 	}
 
 	if hasLegacyList {
-		return parsedOperatorTarget{}, fmt.Errorf("invalid %s.target.list: use %s.target.merge.defaults.list instead", fieldPrefix, fieldPrefix)
+		return parsedOperatorTarget{}, fieldError(fieldPrefix+".target.list", fmt.Errorf("invalid %s.target.list: use %s.target.merge.defaults.list instead", fieldPrefix, fieldPrefix))
 	}
 
 	if !supportsListStrategy && hasMerge {
-		return parsedOperatorTarget{}, fmt.Errorf("invalid %s.target.merge: only list_filter and list_extract support target.merge", fieldPrefix)
+		return parsedOperatorTarget{}, fieldError(fieldPrefix+".target.merge", fmt.Errorf("invalid %s.target.merge: only list_filter and list_extract support target.merge", fieldPrefix))
 	}
 	if meta.IgnoreNotFound && !supportsIgnoreNotFound {
-		return parsedOperatorTarget{}, fmt.Errorf("invalid %s.target.ignore_not_found: only list_extract supports target.ignore_not_found", fieldPrefix)
+		return parsedOperatorTarget{}, fieldError(fieldPrefix+".target.ignore_not_found", fmt.Errorf("invalid %s.target.ignore_not_found: only list_extract supports target.ignore_not_found", fieldPrefix))
 	}
 
 	targetMerge := layerMergeStrategy{defaults: defaultMergeStrategy}
 	if hasMerge {
 		if meta.Merge.Defaults.Map != "" {
-			return parsedOperatorTarget{}, fmt.Errorf("invalid %s.target.merge.defaults.map: target.merge only supports defaults.list", fieldPrefix)
+			return parsedOperatorTarget{}, fieldError(fieldPrefix+".target.merge.defaults.map", fmt.Errorf("invalid %s.target.merge.defaults.map: target.merge only supports defaults.list", fieldPrefix))
 		}
 		if len(meta.Merge.Paths) > 0 {
-			return parsedOperatorTarget{}, fmt.Errorf("invalid %s.target.merge.paths: target.merge only supports defaults.list", fieldPrefix)
+			return parsedOperatorTarget{}, fieldError(fieldPrefix+".target.merge.paths", fmt.Errorf("invalid %s.target.merge.paths: target.merge only supports defaults.list", fieldPrefix))
 		}
 
 		strategy, err := buildLayerMergeStrategy(meta.Merge)
 		if err != nil {
-			return parsedOperatorTarget{}, fmt.Errorf("invalid %s.target.merge: %w", fieldPrefix, err)
+			return parsedOperatorTarget{}, fieldError(fieldPrefix+".target.merge", fmt.Errorf("invalid %s.target.merge: %w", fieldPrefix, err))
 		}
 		targetMerge = strategy
 	}
@@ -363,7 +363,7 @@ func parseOperatorTarget(meta layerTransformTarget, sourcePathRaw string, fieldP
 
 	targetPath, err := splitDotPath(targetPathRaw)
 	if err != nil {
-		return parsedOperatorTarget{}, fmt.Errorf("invalid %s.target.path %q: %w", fieldPrefix, targetPathRaw, err)
+		return parsedOperatorTarget{}, fieldError(fieldPrefix+".target.path", fmt.Errorf("invalid %s.target.path %q: %w", fieldPrefix, targetPathRaw, err))
 	}
 
 	return parsedOperatorTarget{path: targetPath, merge: targetMerge, ignoreNotFound: meta.IgnoreNotFound}, nil
@@ -374,7 +374,7 @@ func compileRegexList(raw []string, fieldName string) ([]*regexp.Regexp, error)
 	for i, expr := range raw {
 		re, err := regexp.Compile(expr)
 		if err != nil {
-			return nil, fmt.Errorf("invalid %s[%d] %q: %w", fieldName, i, expr, err)
+			return nil, fieldError(fmt.Sprintf("%s[%d]", fieldName, i), fmt.Errorf("invalid %s[%d] %q: %w", fieldName, i, expr, err))
 		}
 		out = append(out, re)
 	}
@@ -387,17 +387,17 @@ func parseOperatorSource(meta layerTransformSource, fieldPrefix string, defaultF
 		from = defaultFrom
 	}
 	if from != transformSourceFile && from != transformSourceState && from != transformSourceLayer {
-		return parsedOperatorSource{}, fmt.Errorf("invalid %s.source.from %q: supported values: file, state, layer", fieldPrefix, meta.From)
+		return parsedOperatorSource{}, fieldError(fieldPrefix+".source.from", fmt.Errorf("invalid %s.source.from %q: supported values: file, state, layer", fieldPrefix, meta.From))
 	}
 	if from == transformSourceFile && meta.File == "" {
-		return parsedOperatorSource{}, fmt.Errorf("invalid %s.source.file: cannot be empty when source.from=file", fieldPrefix)
+		return parsedOperatorSource{}, fieldError(fieldPrefix+".source.file", fmt.Errorf("invalid %s.source.file: cannot be empty when source.from=file", fieldPrefix))
 	}
 	if from != transformSourceFile && meta.File != "" {
-		return parsedOperatorSource{}, fmt.Errorf("invalid %s.source.file: must be empty when source.from is not file", fieldPrefix)
+		return parsedOperatorSource{}, fieldError(fieldPrefix+".source.file", fmt.Errorf("invalid %s.source.file: must be empty when source.from is not file", fieldPrefix))
 	}
 
 	if pathRequirement == sourcePathRequired && meta.Path == "" {
-		return parsedOperatorSource{}, fmt.Errorf("invalid %s.source.path %q: path cannot be empty", fieldPrefix, meta.Path)
+		return parsedOperatorSource{}, fieldError(fieldPrefix+".source.path", fmt.Errorf("invalid %s.source.path %q: path cannot be empty", fieldPrefix, meta.Path))
 	}
 	if meta.Path == "" {
 		return parsedOperatorSource{from: from, file: meta.File}, nil
@@ -405,7 +405,7 @@ func parseOperatorSource(meta layerTransformSource, fieldPrefix string, defaultF
 
 	path, err := splitDotPath(meta.Path)
 	if err != nil {
-		return parsedOperatorSource{}, fmt.Errorf("invalid %s.source.path %q: %w", fieldPrefix, meta.Path, err)
+		return parsedOperatorSource{}, fieldError(fieldPrefix+".source.path", fmt.Errorf("invalid %s.source.path %q: %w", fieldPrefix, meta.Path, err))
 	}
 
 	return parsedOperatorSource{
@@ -423,8 +423,14 @@ func parseIncludeMode(raw string, fieldName string) (includeMode, error) {
 
 	mode := includeMode(raw)
 	if mode != includeModeAny && mode != includeModeAll {
-		return "", fmt.Errorf("invalid %s %q: supported values: any, all", fieldName, raw)
+		return "", fieldError(fieldName, fmt.Errorf("invalid %s %q: supported values: any, all", fieldName, raw))
 	}
 
 	return mode, nil
 }
+
+// fieldError marks err as a problem with the operator metadata field, e.g.
+// "operators[0].source.path", so it can be positioned in the layer file.
+func fieldError(field string, err error) error {
+	return &OperatorConfigError{Field: field, Err: err}
+}
@@ -1,63 +1,73 @@
 package compose
 
 import (
+	"context"
 	"errors"
 	"fmt"
+
+	"gopkg.in/yaml.v3"
 )
 
 type operatorExecutionResult struct {
-	state       map[string]any
-	output      any
+	state       *yaml.Node
+	output      *yaml.Node
 	writeTarget bool
+	// directives are the inline merge directives a merge applied, by path.
+	directives map[string]mergeDirective
 }
 
-func (c *Compose) applyLayerOperator(layer map[string]any, operator layerTransform, state map[string]any) (map[string]any, map[string]any, error) {
+// applyLayerOperator runs operator against the layer data and the composed
+// state, attributing every value it introduces to origin.  It also returns
+// the inline merge directives the operator applied.
+func (c *composeRun) applyLayerOperator(ctx context.Context, layer *yaml.Node, operator layerTransform, state *yaml.Node, origin Origin) (*yaml.Node, *yaml.Node, map[string]mergeDirective, error) {
 	if layer == nil {
-		layer = map[string]any{}
+		layer = newMappingNode()
 	}
 	if state == nil {
-		state = map[string]any{}
+		state = newMappingNode()
 	}
 
-	input, err := c.resolveOperatorInput(operator, layer, state)
+	input, err := c.resolveOperatorInput(ctx, operator, layer, state)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	result, err := c.executeOperator(operator, input, state)
+	result, err := c.executeOperator(ctx, operator, input, state)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	state = result.state
+	c.provenance.claim(state, origin)
 
 	if !result.writeTarget {
-		return layer, state, nil
+		return layer, state, result.directives, nil
 	}
 
 	output, err := resolveTargetOutput(operator, layer, state, result.output)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
+	c.provenance.claim(output, origin)
 	if err := setMapValueAtPath(layer, operator.targetPath, output); err != nil {
 		if operator.ignoreTargetNotFound && errors.Is(err, errPathSelectorNoMatch) {
-			return layer, state, nil
+			c.warn(origin, "ignore_not_found discarded the output: %v", err)
+			return layer, state, result.directives, nil
 		}
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	return layer, state, nil
+	return layer, state, result.directives, nil
 }
 
-func resolveTargetOutput(operator layerTransform, layer map[string]any, state map[string]any, output any) (any, error) {
+func resolveTargetOutput(operator layerTransform, layer *yaml.Node, state *yaml.Node, output *yaml.Node) (*yaml.Node, error) {
 	targetListStrategy := operator.targetMerge.defaults.List
 	if targetListStrategy == "" || targetListStrategy == listMergeOverride {
 		return output, nil
 	}
 
-	outputList, ok := output.([]any)
-	if !ok {
-		return nil, fmt.Errorf("target.merge.defaults.list %q requires list output, got %T", targetListStrategy, output)
+	if !isSequenceNode(output) {
+		return nil, fmt.Errorf("target.merge.defaults.list %q requires list output, got %s", targetListStrategy, nodeKindName(output))
 	}
 
 	existing, found := getValueAtPath(layer, operator.targetPath)
@@ -65,19 +75,19 @@ func resolveTargetOutput(operator layerTransform, layer map[string]any, state ma
 		existing, found = getValueAtPath(state, operator.targetPath)
 	}
 	if !found {
-		return outputList, nil
+		return output, nil
 	}
 
-	existingList, ok := existing.([]any)
-	if !ok {
-		return nil, fmt.Errorf("target path %q must resolve to a list when target.merge.defaults.list=%q", normalizePath(operator.targetPath), targetListStrategy)
+	if !isSequenceNode(existing) {
+		err := fmt.Errorf("target path %q must resolve to a list when target.merge.defaults.list=%q", normalizePath(operator.targetPath), targetListStrategy)
+		return nil, &PathError{Path: normalizePath(operator.targetPath), Err: err}
 	}
 
-	return mergeValue(existingList, outputList, operator.targetMerge, operator.targetPath), nil
+	return mergeValue(existing, output, operator.targetMerge, operator.targetPath)
 }
 
-func (c *Compose) resolveOperatorInput(operator layerTransform, layer map[string]any, state map[string]any) (any, error) {
-	sourceData, err := c.readOperatorSourceData(operator, layer, state)
+func (c *composeRun) resolveOperatorInput(ctx context.Context, operator layerTransform, layer *yaml.Node, state *yaml.Node) (*yaml.Node, error) {
+	sourceData, err := c.readOperatorSourceData(ctx, operator, layer, state)
 	if err != nil {
 		return nil, err
 	}
@@ -88,18 +98,19 @@ func (c *Compose) resolveOperatorInput(operator layerTransform, layer map[string
 
 	input, ok := getValueAtPath(sourceData, operator.sourcePath)
 	if !ok {
-		return nil, fmt.Errorf("source path %q not found", normalizePath(operator.sourcePath))
+		err := fmt.Errorf("source path %q not found", normalizePath(operator.sourcePath))
+		return nil, &PathError{Path: normalizePath(operator.sourcePath), Err: err}
 	}
 
 	return input, nil
 }
 
-func (c *Compose) readOperatorSourceData(operator layerTransform, layer map[string]any, state map[string]any) (any, error) {
+func (c *composeRun) readOperatorSourceData(ctx context.Context, operator layerTransform, layer *yaml.Node, state *yaml.Node) (*yaml.Node, error) {
 	switch operator.sourceFrom {
 	case transformSourceState:
 		return state, nil
 	case transformSourceFile:
-		return c.readSourceYAML(operator.sourceFile)
+		return c.readSourceFile(ctx, operator.sourceFile)
 	case transformSourceLayer:
 		return layer, nil
 	default:
@@ -107,16 +118,16 @@ func (c *Compose) readOperatorSourceData(operator layerTransform, layer map[stri
 	}
 }
 
-func (c *Compose) executeOperator(operator layerTransform, input any, state map[string]any) (operatorExecutionResult, error) {
+func (c *composeRun) executeOperator(ctx context.Context, operator layerTransform, input *yaml.Node, state *yaml.Node) (operatorExecutionResult, error) {
 	switch operator.kind {
 	case transformKindMerge:
 		return executeMergeOperator(input, operator, state)
 	case transformKindListFilter:
-		return executeListFilterOperator(input, operator, state)
+		return executeListFilterOperator(ctx, input, operator, state)
 	case transformKindListExtract:
-		return executeListExtractOperator(input, operator, state)
+		return executeListExtractOperator(ctx, input, operator, state)
 	case transformKindListRemove:
-		return executeListRemoveOperator(input, operator, state)
+		return executeListRemoveOperator(ctx, input, operator, state)
 	case transformKindReplaceVals:
 		return c.executeReplaceValuesOperator(input, operator, state)
 	default:
@@ -124,36 +135,40 @@ func (c *Compose) executeOperator(operator layerTransform, input any, state map[
 	}
 }
 
-func executeMergeOperator(input any, operator layerTransform, state map[string]any) (operatorExecutionResult, error) {
+func executeMergeOperator(input *yaml.Node, operator layerTransform, state *yaml.Node) (operatorExecutionResult, error) {
 	inputMap, err := requireMapInput(input, operator.sourcePath)
 	if err != nil {
 		return operatorExecutionResult{}, err
 	}
 
-	return operatorExecutionResult{
-		state: mergeMapsWithStrategy(state, inputMap, operator.merge, nil),
-	}, nil
+	merged, err := mergeMapsWithStrategy(state, inputMap, operator.merge, nil)
+	if err != nil {
+		return operatorExecutionResult{}, err
+	}
+	directives := collectMergeDirectives(inputMap)
+	stripMergeDirectives(inputMap)
+	return operatorExecutionResult{state: merged, directives: directives}, nil
 }
 
-func executeListFilterOperator(input any, operator layerTransform, state map[string]any) (operatorExecutionResult, error) {
-	return executeListOutputOperator(input, operator.sourcePath, state, func(inputList []any) (any, error) {
-		return applyListFilter(inputList, operator.listFilter)
+func executeListFilterOperator(ctx context.Context, input *yaml.Node, operator layerTransform, state *yaml.Node) (operatorExecutionResult, error) {
+	return executeListOutputOperator(input, operator.sourcePath, state, func(inputList *yaml.Node) (*yaml.Node, error) {
+		return applyListFilter(ctx, inputList, operator.listFilter)
 	})
 }
 
-func executeListExtractOperator(input any, operator layerTransform, state map[string]any) (operatorExecutionResult, error) {
-	return executeListOutputOperator(input, operator.sourcePath, state, func(inputList []any) (any, error) {
-		return applyListExtract(inputList, operator.listExtract)
+func executeListExtractOperator(ctx context.Context, input *yaml.Node, operator layerTransform, state *yaml.Node) (operatorExecutionResult, error) {
+	return executeListOutputOperator(input, operator.sourcePath, state, func(inputList *yaml.Node) (*yaml.Node, error) {
+		return applyListExtract(ctx, inputList, operator.listExtract)
 	})
 }
 
-func executeListRemoveOperator(input any, operator layerTransform, state map[string]any) (operatorExecutionResult, error) {
-	return executeListOutputOperator(input, operator.sourcePath, state, func(inputList []any) (any, error) {
-		return applyListRemove(inputList, operator.listRemove)
+func executeListRemoveOperator(ctx context.Context, input *yaml.Node, operator layerTransform, state *yaml.Node) (operatorExecutionResult, error) {
+	return executeListOutputOperator(input, operator.sourcePath, state, func(inputList *yaml.Node) (*yaml.Node, error) {
+		return applyListRemove(ctx, inputList, operator.listRemove)
 	})
 }
 
-func executeListOutputOperator(input any, sourcePath []string, state map[string]any, apply func([]any) (any, error)) (operatorExecutionResult, error) {
+func executeListOutputOperator(input *yaml.Node, sourcePath []string, state *yaml.Node, apply func(*yaml.Node) (*yaml.Node, error)) (operatorExecutionResult, error) {
 	inputList, err := requireListInput(input, sourcePath)
 	if err != nil {
 		return operatorExecutionResult{}, err
@@ -167,7 +182,7 @@ func executeListOutputOperator(input any, sourcePath []string, state map[string]
 	return newWriteTargetResult(state, output), nil
 }
 
-func (c *Compose) executeReplaceValuesOperator(input any, operator layerTransform, state map[string]any) (operatorExecutionResult, error) {
+func (c *Compose) executeReplaceValuesOperator(input *yaml.Node, operator layerTransform, state *yaml.Node) (operatorExecutionResult, error) {
 	output, originals := applyReplaceValues(input, operator.replaceVals)
 	if err := c.printReplacedOriginals(originals, operator.replaceVals.printOriginal); err != nil {
 		return operatorExecutionResult{}, err
@@ -190,7 +205,7 @@ func (c *Compose) printReplacedOriginals(originals []string, enabled bool) error
 	return nil
 }
 
-func newWriteTargetResult(state map[string]any, output any) operatorExecutionResult {
+func newWriteTargetResult(state *yaml.Node, output *yaml.Node) operatorExecutionResult {
 	return operatorExecutionResult{
 		state:       state,
 		output:      output,
@@ -198,20 +213,20 @@ func newWriteTargetResult(state map[string]any, output any) operatorExecutionRes
 	}
 }
 
-func requireListInput(input any, sourcePath []string) ([]any, error) {
-	inputList, ok := input.([]any)
-	if !ok {
-		return nil, fmt.Errorf("source path %q must resolve to a list", normalizePath(sourcePath))
+func requireListInput(input *yaml.Node, sourcePath []string) (*yaml.Node, error) {
+	if !isSequenceNode(input) {
+		err := fmt.Errorf("source path %q must resolve to a list", normalizePath(sourcePath))
+		return nil, &PathError{Path: normalizePath(sourcePath), Err: err}
 	}
 
-	return inputList, nil
+	return input, nil
 }
 
-func requireMapInput(input any, sourcePath []string) (map[string]any, error) {
-	inputMap, ok := input.(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("source path %q must resolve to an object", normalizePath(sourcePath))
+func requireMapInput(input *yaml.Node, sourcePath []string) (*yaml.Node, error) {
+	if !isMappingNode(input) {
+		err := fmt.Errorf("source path %q must resolve to an object", normalizePath(sourcePath))
+		return nil, &PathError{Path: normalizePath(sourcePath), Err: err}
 	}
 
-	return inputMap, nil
+	return input, nil
 }
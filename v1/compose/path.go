@@ -5,32 +5,34 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 var errPathSelectorNoMatch = errors.New("selector matched no array item")
 
 // getValueAtPath traverses root following the given path segments and returns
-// the value found, or (nil, false) if any segment is not reachable.
-func getValueAtPath(root any, path []string) (any, bool) {
+// the node found, or (nil, false) if any segment is not reachable.
+func getValueAtPath(root *yaml.Node, path []string) (*yaml.Node, bool) {
 	if len(path) == 0 {
 		return root, true
 	}
 
 	cur := root
 	for _, segment := range path {
-		switch typed := cur.(type) {
-		case map[string]any:
-			next, ok := typed[segment]
+		switch {
+		case isMappingNode(cur):
+			next, ok := mappingValue(cur, segment)
 			if !ok {
 				return nil, false
 			}
 			cur = next
-		case []any:
+		case isSequenceNode(cur):
 			if index, ok := parsePathIndex(segment); ok {
-				if index < 0 || index >= len(typed) {
+				if index < 0 || index >= len(cur.Content) {
 					return nil, false
 				}
-				cur = typed[index]
+				cur = cur.Content[index]
 				continue
 			}
 
@@ -38,11 +40,11 @@ func getValueAtPath(root any, path []string) (any, bool) {
 			if !ok {
 				return nil, false
 			}
-			index, ok := findArrayObjectBySelector(typed, selectorKey, selectorValue)
+			index, ok := findArrayObjectBySelector(cur.Content, selectorKey, selectorValue)
 			if !ok {
 				return nil, false
 			}
-			cur = typed[index]
+			cur = cur.Content[index]
 		default:
 			return nil, false
 		}
@@ -52,35 +54,42 @@ func getValueAtPath(root any, path []string) (any, bool) {
 }
 
 // setMapValueAtPath writes value into root at the given path, creating
-// intermediate map nodes as needed.  Returns an error if the path is
+// intermediate mapping nodes as needed.  Returns a *PathError if the path is
 // unwritable (e.g. out-of-range index, ambiguous selector).
-func setMapValueAtPath(root map[string]any, path []string, value any) error {
+func setMapValueAtPath(root *yaml.Node, path []string, value *yaml.Node) error {
+	if err := writeValueAtPath(root, path, value); err != nil {
+		return &PathError{Path: normalizePath(path), Err: err}
+	}
+	return nil
+}
+
+func writeValueAtPath(root *yaml.Node, path []string, value *yaml.Node) error {
 	if len(path) == 0 {
 		return fmt.Errorf("path cannot be empty")
 	}
 
-	var cur any = root
+	cur := root
 	for i := 0; i < len(path)-1; i++ {
 		segment := path[i]
-		switch typed := cur.(type) {
-		case map[string]any:
-			next, ok := typed[segment]
+		switch {
+		case isMappingNode(cur):
+			next, ok := mappingValue(cur, segment)
 			if !ok {
 				if _, isIndex := parsePathIndex(path[i+1]); isIndex {
 					return fmt.Errorf("target path %q is not writable: segment %q must be an array", normalizePath(path), normalizePath(path[:i+1]))
 				}
-				child := map[string]any{}
-				typed[segment] = child
+				child := newMappingNode()
+				mappingSet(cur, segment, child)
 				cur = child
 				continue
 			}
 			cur = next
-		case []any:
+		case isSequenceNode(cur):
 			if index, ok := parsePathIndex(segment); ok {
-				if index < 0 || index >= len(typed) {
+				if index < 0 || index >= len(cur.Content) {
 					return fmt.Errorf("target path %q is not writable: index %d out of range at segment %q", normalizePath(path), index, normalizePath(path[:i+1]))
 				}
-				cur = typed[index]
+				cur = cur.Content[index]
 				continue
 			}
 
@@ -89,27 +98,27 @@ func setMapValueAtPath(root map[string]any, path []string, value any) error {
 				return fmt.Errorf("target path %q is not writable: segment %q must be an array index or selector", normalizePath(path), normalizePath(path[:i+1]))
 			}
 
-			index, err := findUniqueArrayObjectBySelector(typed, selectorKey, selectorValue)
+			index, err := findUniqueArrayObjectBySelector(cur.Content, selectorKey, selectorValue)
 			if err != nil {
 				return fmt.Errorf("target path %q is not writable: %w", normalizePath(path), err)
 			}
-			cur = typed[index]
+			cur = cur.Content[index]
 		default:
 			return fmt.Errorf("target path %q is not writable: segment %q is not an object or array", normalizePath(path), normalizePath(path[:i+1]))
 		}
 	}
 
 	lastSegment := path[len(path)-1]
-	switch typed := cur.(type) {
-	case map[string]any:
-		typed[lastSegment] = value
+	switch {
+	case isMappingNode(cur):
+		mappingSet(cur, lastSegment, value)
 		return nil
-	case []any:
+	case isSequenceNode(cur):
 		if index, ok := parsePathIndex(lastSegment); ok {
-			if index < 0 || index >= len(typed) {
+			if index < 0 || index >= len(cur.Content) {
 				return fmt.Errorf("target path %q is not writable: final index %d out of range", normalizePath(path), index)
 			}
-			typed[index] = value
+			cur.Content[index] = value
 			return nil
 		}
 
@@ -117,11 +126,11 @@ func setMapValueAtPath(root map[string]any, path []string, value any) error {
 		if !ok {
 			return fmt.Errorf("target path %q is not writable: final segment %q must be an array index or selector", normalizePath(path), normalizePath(path))
 		}
-		index, err := findUniqueArrayObjectBySelector(typed, selectorKey, selectorValue)
+		index, err := findUniqueArrayObjectBySelector(cur.Content, selectorKey, selectorValue)
 		if err != nil {
 			return fmt.Errorf("target path %q is not writable: %w", normalizePath(path), err)
 		}
-		typed[index] = value
+		cur.Content[index] = value
 		return nil
 	default:
 		return fmt.Errorf("target path %q is not writable: parent is not an object or array", normalizePath(path))
@@ -170,7 +179,7 @@ func parsePathSelector(segment string) (string, string, bool) {
 	return key, value, true
 }
 
-func findArrayObjectBySelector(items []any, key string, expected string) (int, bool) {
+func findArrayObjectBySelector(items []*yaml.Node, key string, expected string) (int, bool) {
 	index, err := findUniqueArrayObjectBySelector(items, key, expected)
 	if err != nil {
 		return 0, false
@@ -178,20 +187,19 @@ func findArrayObjectBySelector(items []any, key string, expected string) (int, b
 	return index, true
 }
 
-func findUniqueArrayObjectBySelector(items []any, key string, expected string) (int, error) {
+func findUniqueArrayObjectBySelector(items []*yaml.Node, key string, expected string) (int, error) {
 	matches := make([]int, 0)
 	for i, item := range items {
-		m, ok := item.(map[string]any)
-		if !ok {
-			return 0, fmt.Errorf("selector [%s=%s] requires object array items, got %T at index %d", key, expected, item, i)
+		if !isMappingNode(item) {
+			return 0, fmt.Errorf("selector [%s=%s] requires object array items, got %s at index %d", key, expected, nodeKindName(item), i)
 		}
-		raw, ok := m[key]
+		raw, ok := mappingValue(item, key)
 		if !ok {
 			continue
 		}
-		actual, ok := raw.(string)
+		actual, ok := stringValue(raw)
 		if !ok {
-			return 0, fmt.Errorf("selector [%s=%s] requires string field %q, got %T at index %d", key, expected, key, raw, i)
+			return 0, fmt.Errorf("selector [%s=%s] requires string field %q, got %s at index %d", key, expected, key, nodeKindName(raw), i)
 		}
 		if actual == expected {
 			matches = append(matches, i)
@@ -220,8 +228,16 @@ func normalizeDotPath(path string) (string, error) {
 
 // splitDotPath splits a dot-separated path string into individual segments,
 // honouring backslash escapes and bracket notation for array indices and
-// selectors.
+// selectors.  Returns a *PathError if the path is malformed.
 func splitDotPath(path string) ([]string, error) {
+	parts, err := parseDotPath(path)
+	if err != nil {
+		return nil, &PathError{Path: path, Err: err}
+	}
+	return parts, nil
+}
+
+func parseDotPath(path string) ([]string, error) {
 	if path == "" {
 		return nil, fmt.Errorf("path cannot be empty")
 	}
@@ -0,0 +1,46 @@
+package compose
+
+import "slices"
+
+// SetProfiles sets the active profiles.  A layer whose metadata document
+// lists profiles or tags is applied only when one of them is active; layers
+// without profiles and tags are always applied.  The profiles also activate
+// the profile subdirectories of LayerDirs, see DiscoverOptions.Profiles.
+func (c *Compose) SetProfiles(profiles ...string) {
+	c.profiles = append([]string(nil), profiles...)
+}
+
+// discoverOptions returns the options layers are discovered in LayerDirs and
+// the layer directory of a NewFromFS Compose with: the layer filter, with the active profiles added.
+func (c *Compose) discoverOptions() DiscoverOptions {
+	opts := c.layerFilter
+	if len(c.profiles) > 0 {
+		opts.Profiles = append(append([]string(nil), opts.Profiles...), c.profiles...)
+	}
+	return opts
+}
+
+// layerActivation is the profiles and tags a layer declares in its metadata
+// document.
+type layerActivation struct {
+	profiles []string
+	tags     []string
+}
+
+func (m layerMetadata) activation() layerActivation {
+	return layerActivation{profiles: m.Profiles, tags: m.Tags}
+}
+
+// active reports whether a layer with activation a is applied with the given
+// active profiles.
+func (a layerActivation) active(profiles []string) bool {
+	if len(a.profiles) == 0 && len(a.tags) == 0 {
+		return true
+	}
+	for _, profile := range profiles {
+		if slices.Contains(a.profiles, profile) || slices.Contains(a.tags, profile) {
+			return true
+		}
+	}
+	return false
+}
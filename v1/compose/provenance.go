@@ -0,0 +1,187 @@
+package compose
+
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Origin describes where a composed value came from.
+type Origin struct {
+	// File is the file the value was read from; empty when the value was
+	// derived from the composed state.
+	File string
+	// Line is the 1-based line of the value in File, or 0 when unknown.
+	Line int
+	// Layer is the layer filename that wrote the value; empty for the base.
+	Layer string
+	// Operator is the index of the operator in the layer's operators list,
+	// or -1 for the base and for the implicit merge operator.
+	Operator int
+	// Kind is the kind of the operator that wrote the value.
+	Kind string
+}
+
+// String renders the origin the way annotated output shows it, e.g.
+// "2-prod.yaml operators[1]".
+func (o Origin) String() string {
+	if o.Layer == "" {
+		return o.File
+	}
+	if o.Operator < 0 {
+		return o.Layer
+	}
+	return fmt.Sprintf("%s operators[%d]", o.Layer, o.Operator)
+}
+
+// Provenance maps every leaf path of the composed document, written as
+// "app.db.host" or "app.backends[0].name", to the origin of its value.
+type Provenance map[string]Origin
+
+// provenanceTracker attributes composed nodes to the layer and operator
+// that introduced them.  Origins are keyed by node identity so they follow
+// values as lists are reordered or merged.
+type provenanceTracker struct {
+	origins map[*yaml.Node]Origin
+	// claims numbers the claim that recorded each origin, so the newest
+	// origin under a collection can be found.
+	claims map[*yaml.Node]int
+	last   int
+}
+
+func newProvenanceTracker() *provenanceTracker {
+	return &provenanceTracker{origins: map[*yaml.Node]Origin{}, claims: map[*yaml.Node]int{}}
+}
+
+// claim records origin for every leaf under n that has no origin yet.  The
+// line number is taken from each leaf when the origin names a file.
+func (t *provenanceTracker) claim(n *yaml.Node, origin Origin) {
+	if t == nil {
+		return
+	}
+	t.last++
+	walkLeaves(n, "", func(_ string, leaf *yaml.Node) {
+		if _, ok := t.origins[leaf]; ok {
+			return
+		}
+		o := origin
+		if o.File != "" {
+			o.Line = leaf.Line
+		}
+		t.origins[leaf] = o
+		t.claims[leaf] = t.last
+	})
+}
+
+// origin returns the origin of n.  Collections have no origin of their own
+// and take the newest origin among their leaves, the last operator that
+// wrote into them.
+func (t *provenanceTracker) origin(n *yaml.Node) (Origin, bool) {
+	var origin Origin
+	newest := 0
+	walkLeaves(n, "", func(_ string, leaf *yaml.Node) {
+		if claim, ok := t.claims[leaf]; ok && claim > newest {
+			origin, newest = t.origins[leaf], claim
+		}
+	})
+	return origin, newest > 0
+}
+
+// collect returns the provenance of every leaf reachable from root.
+func (t *provenanceTracker) collect(root *yaml.Node) Provenance {
+	out := Provenance{}
+	walkLeaves(root, "", func(path string, leaf *yaml.Node) {
+		if o, ok := t.origins[leaf]; ok {
+			out[path] = o
+		}
+	})
+	return out
+}
+
+// annotate appends a "from <layer> operators[i]" line comment to every leaf
+// written by a layer.  Flow collections holding annotated leaves switch to
+// block style so each comment gets its own line.
+func (t *provenanceTracker) annotate(root *yaml.Node) {
+	t.annotateNode(root, map[*yaml.Node]bool{})
+}
+
+func (t *provenanceTracker) annotateNode(n *yaml.Node, seen map[*yaml.Node]bool) bool {
+	if n == nil {
+		return false
+	}
+	if isLeafNode(n) {
+		o, ok := t.origins[n]
+		if !ok || o.Layer == "" {
+			return false
+		}
+		if seen[n] {
+			return true
+		}
+		seen[n] = true
+		comment := "from " + o.String()
+		if n.LineComment != "" {
+			comment = n.LineComment + " # " + comment
+		}
+		n.LineComment = comment
+		return true
+	}
+
+	annotated := false
+	for i, child := range n.Content {
+		if n.Kind == yaml.MappingNode && i%2 == 0 {
+			continue
+		}
+		if t.annotateNode(child, seen) {
+			annotated = true
+		}
+	}
+	if annotated {
+		n.Style &^= yaml.FlowStyle
+	}
+	return annotated
+}
+
+// isLeafNode reports whether n is a scalar or an empty collection.
+func isLeafNode(n *yaml.Node) bool {
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode, yaml.DocumentNode:
+		return len(n.Content) == 0
+	default:
+		return true
+	}
+}
+
+// walkLeaves calls fn for every leaf under n together with its path.
+func walkLeaves(n *yaml.Node, path string, fn func(path string, leaf *yaml.Node)) {
+	if n == nil {
+		return
+	}
+	if isLeafNode(n) {
+		fn(path, n)
+		return
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			walkLeaves(n.Content[i+1], joinPathKey(path, n.Content[i].Value), fn)
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			walkLeaves(item, joinPathIndex(path, i), fn)
+		}
+	case yaml.DocumentNode:
+		walkLeaves(n.Content[0], path, fn)
+	}
+}
+
+func joinPathKey(prefix string, key string) string {
+	if prefix == "" {
+		return escapeDotPathSegment(key)
+	}
+	return prefix + "." + escapeDotPathSegment(key)
+}
+
+func joinPathIndex(prefix string, index int) string {
+	return prefix + "[" + strconv.Itoa(index) + "]"
+}
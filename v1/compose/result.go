@@ -0,0 +1,105 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Result is a composed document together with what was done to build it.
+type Result struct {
+	// Document is the composed document node.  Its root is a mapping; with
+	// annotation enabled it carries the "# from" comments.
+	Document *yaml.Node
+	// Provenance is the origin of every leaf value in Document.
+	Provenance Provenance
+	Metadata
+}
+
+// Metadata describes a compose run.
+type Metadata struct {
+	// LayersApplied lists the layer filenames in the order they were
+	// applied.
+	LayersApplied []string
+	// LayersSkipped lists the layer filenames left out because none of
+	// their profiles or tags is active or their when clause did not hold.
+	LayersSkipped []string
+	// FilesRead lists the base, layer and source files read, in the order
+	// they were first read.
+	FilesRead []string
+	// Warnings lists problems that did not stop the run.
+	Warnings []Warning
+}
+
+// Warning is a problem that did not stop a compose run, such as an operator
+// output discarded because of target.ignore_not_found.
+type Warning struct {
+	// Layer is the layer filename.
+	Layer string
+	// Operator is the index in the layer's operators list, or -1 for the
+	// implicit merge operator.
+	Operator int
+	Message  string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("layer %q operators[%d]: %s", w.Layer, w.Operator, w.Message)
+}
+
+// Map decodes the composed document into a map.
+func (r *Result) Map() (map[string]any, error) {
+	out := map[string]any{}
+	if err := r.Document.Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode compose result: %w", err)
+	}
+	return out, nil
+}
+
+// Compose applies every layer to the base and returns the composed document
+// without marshalling it.  Like RunContext it gives up with ctx.Err() once ctx
+// is done.
+func (c *Compose) Compose(ctx context.Context) (*Result, error) {
+	result, _, err := c.compose(ctx)
+	return result, err
+}
+
+// compose is Compose returning the run too, so callers can look up the origin
+// of composed nodes.
+func (c *Compose) compose(ctx context.Context) (*Result, *composeRun, error) {
+	run := c.newRun()
+	doc, err := run.composeDocument(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &Result{
+		Document:   doc,
+		Provenance: run.provenance.collect(doc),
+		Metadata:   *run.metadata,
+	}
+	if c.annotate {
+		run.provenance.annotate(doc)
+	}
+	return result, run, nil
+}
+
+// recordFileRead adds path to the files read by the current run.
+func (c *composeRun) recordFileRead(path string) {
+	for _, read := range c.metadata.FilesRead {
+		if read == path {
+			return
+		}
+	}
+	c.metadata.FilesRead = append(c.metadata.FilesRead, path)
+}
+
+// warn adds a warning about the operator that wrote origin to the current
+// run.
+func (c *composeRun) warn(origin Origin, format string, args ...any) {
+	c.metadata.Warnings = append(c.metadata.Warnings, Warning{
+		Layer:    origin.Layer,
+		Operator: origin.Operator,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
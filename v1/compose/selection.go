@@ -0,0 +1,135 @@
+package compose
+
+import "fmt"
+
+// LayerSelection narrows the sorted layer stack, e.g. to bisect a
+// configuration problem.  Patterns are globs matched like those of
+// DiscoverOptions against the layer name or, for discovered layers, the
+// path relative to the layer directory; a plain name matches that layer.
+// Every pattern must match at least one layer.
+type LayerSelection struct {
+	// Only keeps the layers matching at least one pattern; every layer when
+	// empty.
+	Only []string
+	// From drops the layers before the first layer matching it.
+	From string
+	// Until drops the layers after the last layer matching it.  It must not
+	// come before the From layer.
+	Until string
+	// Skip drops the layers matching any pattern.
+	Skip []string
+}
+
+// SetLayerSelection makes every subsequent run apply only the layers
+// selected by sel.
+func (c *Compose) SetLayerSelection(sel LayerSelection) {
+	c.selection = sel
+}
+
+// SelectedLayers returns the names of the layers a run applies, in order.
+// Layers may still be skipped during the run by their profiles, tags or
+// when clause.
+func (c *Compose) SelectedLayers() ([]string, error) {
+	specs, errs := c.layerStack()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.name)
+	}
+	return names, nil
+}
+
+// selectLayers applies sel to the sorted stack specs.
+func selectLayers(specs []layerSpec, sel LayerSelection) ([]layerSpec, error) {
+	for _, globs := range [][]string{sel.Only, {sel.From}, {sel.Until}, sel.Skip} {
+		if err := validateGlobs(globs); err != nil {
+			return nil, err
+		}
+	}
+
+	first, last := 0, len(specs)-1
+	if sel.From != "" {
+		first = -1
+		for i, spec := range specs {
+			if spec.matches(sel.From) {
+				first = i
+				break
+			}
+		}
+		if first < 0 {
+			return nil, fmt.Errorf("from layer %q not found", sel.From)
+		}
+	}
+	if sel.Until != "" {
+		last = -1
+		for i := len(specs) - 1; i >= 0; i-- {
+			if specs[i].matches(sel.Until) {
+				last = i
+				break
+			}
+		}
+		if last < 0 {
+			return nil, fmt.Errorf("until layer %q not found", sel.Until)
+		}
+	}
+	if sel.From != "" && sel.Until != "" && first > last {
+		return nil, fmt.Errorf("from layer %q comes after until layer %q", specs[first].name, specs[last].name)
+	}
+
+	if err := requireMatches(specs, sel.Only, "layer %q not found"); err != nil {
+		return nil, err
+	}
+	if err := requireMatches(specs, sel.Skip, "skipped layer %q not found"); err != nil {
+		return nil, err
+	}
+
+	selected := make([]layerSpec, 0, len(specs))
+	for i := first; i <= last; i++ {
+		spec := specs[i]
+		if len(sel.Only) > 0 && !spec.matchesAny(sel.Only) {
+			continue
+		}
+		if spec.matchesAny(sel.Skip) {
+			continue
+		}
+		selected = append(selected, spec)
+	}
+	return selected, nil
+}
+
+// requireMatches reports the first pattern matching none of specs with
+// format.
+func requireMatches(specs []layerSpec, patterns []string, format string) error {
+	for _, pattern := range patterns {
+		found := false
+		for _, spec := range specs {
+			if spec.matches(pattern) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf(format, pattern)
+		}
+	}
+	return nil
+}
+
+// matches reports whether pattern matches the layer name or, for a layer
+// file, its path relative to the layer directory.
+func (s layerSpec) matches(pattern string) bool {
+	globs := []string{pattern}
+	return matchesAnyGlob(s.name, globs) || (s.memory == nil && matchesAnyGlob(s.file, globs))
+}
+
+func (s layerSpec) matchesAny(patterns []string) bool {
+	for _, pattern := range patterns {
+		if s.matches(pattern) {
+			return true
+		}
+	}
+	return false
+}
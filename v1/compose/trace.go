@@ -0,0 +1,156 @@
+package compose
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/spf13/afero"
+)
+
+// TraceStep is a snapshot of the composed state taken after the base was
+// loaded, after every layer operator and after every layer, including the
+// layers and operators skipped by their when clause.
+type TraceStep struct {
+	// Index numbers the steps of one run, starting at 0 for the base.
+	Index int
+	// Name identifies the step, e.g. "002-2-prod.yaml.op1-list_filter".
+	Name string
+	// Layer is the layer filename; empty for the base step.
+	Layer string
+	// Operator is the index of the operator within the layer, or -1 for
+	// the base step and the per-layer step.
+	Operator int
+	// Kind is the operator kind; empty for the base and per-layer steps.
+	Kind string
+	// Skipped is set when the layer or operator was skipped because its when
+	// clause did not hold.
+	Skipped bool
+	// State is the composed state rendered as YAML.
+	State []byte
+	// Diff is a unified diff from the previous step's State to this one;
+	// empty for the base step.
+	Diff string
+}
+
+// TraceSink receives every TraceStep of a compose run.
+type TraceSink interface {
+	WriteStep(step TraceStep) error
+}
+
+// SetTraceSink makes every subsequent run report its intermediate states to
+// sink.  A nil sink disables tracing.
+func (c *Compose) SetTraceSink(sink TraceSink) {
+	c.traceSink = sink
+}
+
+// NewDirTraceSink returns a TraceSink that writes "<name>.yaml" with the
+// state and "<name>.diff" with the diff of every step into dir on fs.
+func NewDirTraceSink(fs afero.Fs, dir string) TraceSink {
+	return &dirTraceSink{fs: &afero.Afero{Fs: fs}, dir: dir}
+}
+
+type dirTraceSink struct {
+	fs  *afero.Afero
+	dir string
+}
+
+func (s *dirTraceSink) WriteStep(step TraceStep) error {
+	if err := s.fs.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("create trace directory: %w", err)
+	}
+
+	statePath := filepath.Join(s.dir, step.Name+".yaml")
+	if err := s.fs.WriteFile(statePath, step.State, 0644); err != nil {
+		return fmt.Errorf("write trace state %q: %w", statePath, err)
+	}
+	if step.Index == 0 {
+		return nil
+	}
+
+	diffPath := filepath.Join(s.dir, step.Name+".diff")
+	if err := s.fs.WriteFile(diffPath, []byte(step.Diff), 0644); err != nil {
+		return fmt.Errorf("write trace diff %q: %w", diffPath, err)
+	}
+	return nil
+}
+
+// tracer turns compose steps into numbered TraceSteps with diffs against
+// the previous step.
+type tracer struct {
+	sink      TraceSink
+	index     int
+	prevName  string
+	prevState string
+}
+
+func newTracer(sink TraceSink) *tracer {
+	if sink == nil {
+		return nil
+	}
+	return &tracer{sink: sink}
+}
+
+func (t *tracer) observe(step composeStep) error {
+	if t == nil {
+		return nil
+	}
+
+	state, err := MarshalYAML(step.state)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	traceStep := TraceStep{
+		Index:    t.index,
+		Name:     traceStepName(t.index, step),
+		Layer:    step.layer,
+		Operator: step.operatorIndex,
+		Skipped:  step.skipped,
+		State:    state,
+	}
+	if step.operator != nil {
+		traceStep.Kind = step.operator.kind
+	}
+	if t.index > 0 {
+		traceStep.Diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(t.prevState),
+			B:        difflib.SplitLines(string(state)),
+			FromFile: t.prevName,
+			ToFile:   traceStep.Name,
+			Context:  3,
+		})
+		if err != nil {
+			return fmt.Errorf("diff state: %w", err)
+		}
+	}
+
+	if err := t.sink.WriteStep(traceStep); err != nil {
+		return err
+	}
+
+	t.index++
+	t.prevName = traceStep.Name
+	t.prevState = string(state)
+	return nil
+}
+
+// traceStepName builds names such as "000-base", "002-2-prod.yaml.op1-list_filter"
+// and "003-2-prod.yaml".  Skipped steps end in ".skipped".
+func traceStepName(index int, step composeStep) string {
+	layer := strings.ReplaceAll(step.layer, string(filepath.Separator), "_")
+	name := ""
+	switch step.kind {
+	case stepBase:
+		return fmt.Sprintf("%03d-base", index)
+	case stepOperator:
+		name = fmt.Sprintf("%03d-%s.op%d-%s", index, layer, step.operatorIndex, step.operator.kind)
+	default:
+		name = fmt.Sprintf("%03d-%s", index, layer)
+	}
+	if step.skipped {
+		name += ".skipped"
+	}
+	return name
+}
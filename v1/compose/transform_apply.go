@@ -1,17 +1,24 @@
 package compose
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"regexp"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 // applyListFilter returns a filtered subset of input, keeping only items
 // whose match candidate satisfies the include/exclude regex rules.
-func applyListFilter(input []any, filter layerListFilter) ([]any, error) {
-	out := make([]any, 0, len(input))
-	for i, item := range input {
+func applyListFilter(ctx context.Context, input *yaml.Node, filter layerListFilter) (*yaml.Node, error) {
+	out := make([]*yaml.Node, 0, len(input.Content))
+	for i, item := range input.Content {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		candidate, err := getFilterCandidate(item, filter.matchPath)
 		if err != nil {
 			return nil, fmt.Errorf("invalid list item at index %d: %w", i, err)
@@ -30,39 +37,35 @@ func applyListFilter(input []any, filter layerListFilter) ([]any, error) {
 		out = append(out, item)
 	}
 
-	return out, nil
+	return withContent(input, out), nil
 }
 
-func rewriteListFilterItem(item any, rewrite layerListFilterRewrite) (any, error) {
+func rewriteListFilterItem(item *yaml.Node, rewrite layerListFilterRewrite) (*yaml.Node, error) {
 	if len(rewrite.path) == 0 {
-		s, ok := item.(string)
+		s, ok := stringValue(item)
 		if !ok {
 			return nil, fmt.Errorf("rewrite without path requires string list item")
 		}
-		return rewrite.prefix + s, nil
+		return withScalarValue(item, rewrite.prefix+s), nil
 	}
 
-	m, ok := item.(map[string]any)
-	if !ok {
+	if !isMappingNode(item) {
 		return nil, fmt.Errorf("rewrite.path %q requires object list item", normalizePath(rewrite.path))
 	}
 
-	cloned, ok := cloneAny(m).(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("failed to clone list item for rewrite")
-	}
+	cloned := cloneNode(item)
 
 	v, found := getValueAtPath(cloned, rewrite.path)
 	if !found {
 		return nil, fmt.Errorf("rewrite.path %q not found", normalizePath(rewrite.path))
 	}
 
-	s, ok := v.(string)
+	s, ok := stringValue(v)
 	if !ok {
 		return nil, fmt.Errorf("rewrite.path %q must resolve to string", normalizePath(rewrite.path))
 	}
 
-	if err := setMapValueAtPath(cloned, rewrite.path, rewrite.prefix+s); err != nil {
+	if err := setMapValueAtPath(cloned, rewrite.path, withScalarValue(v, rewrite.prefix+s)); err != nil {
 		return nil, fmt.Errorf("rewrite.path %q is not writable: %w", normalizePath(rewrite.path), err)
 	}
 
@@ -71,20 +74,23 @@ func rewriteListFilterItem(item any, rewrite layerListFilterRewrite) (any, error
 
 // applyListExtract extracts a string field from each object in input,
 // returning a flat string list filtered by the extract rules.
-func applyListExtract(input []any, extract layerListExtract) ([]any, error) {
-	out := make([]any, 0, len(input))
-	for i, item := range input {
-		m, ok := item.(map[string]any)
-		if !ok {
+func applyListExtract(ctx context.Context, input *yaml.Node, extract layerListExtract) (*yaml.Node, error) {
+	out := make([]*yaml.Node, 0, len(input.Content))
+	for i, item := range input.Content {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if !isMappingNode(item) {
 			return nil, fmt.Errorf("invalid list item at index %d: expected object list item", i)
 		}
 
-		v, ok := getValueAtPath(m, extract.extractPath)
+		v, ok := getValueAtPath(item, extract.extractPath)
 		if !ok {
 			return nil, fmt.Errorf("invalid list item at index %d: extract_path %q not found", i, normalizePath(extract.extractPath))
 		}
 
-		s, ok := v.(string)
+		s, ok := stringValue(v)
 		if !ok {
 			return nil, fmt.Errorf("invalid list item at index %d: extract_path %q must resolve to string", i, normalizePath(extract.extractPath))
 		}
@@ -93,22 +99,25 @@ func applyListExtract(input []any, extract layerListExtract) ([]any, error) {
 			continue
 		}
 
-		out = append(out, s)
+		out = append(out, cloneNode(v))
 	}
 
-	return out, nil
+	return newSequenceNode(out), nil
 }
 
-func applyListRemove(input []any, remove layerListRemove) ([]any, error) {
-	out := make([]any, 0, len(input))
+func applyListRemove(ctx context.Context, input *yaml.Node, remove layerListRemove) (*yaml.Node, error) {
+	out := make([]*yaml.Node, 0, len(input.Content))
 	removed := false
-	for i, item := range input {
-		m, ok := item.(map[string]any)
-		if !ok {
+	for i, item := range input.Content {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if !isMappingNode(item) {
 			return nil, fmt.Errorf("invalid list item at index %d: expected object list item", i)
 		}
 
-		v, ok := getValueAtPath(m, remove.matchPath)
+		v, ok := getValueAtPath(item, remove.matchPath)
 		if !ok {
 			return nil, fmt.Errorf("invalid list item at index %d: match_path %q not found", i, normalizePath(remove.matchPath))
 		}
@@ -131,100 +140,86 @@ func applyListRemove(input []any, remove layerListRemove) ([]any, error) {
 		removed = true
 	}
 
-	return out, nil
+	return withContent(input, out), nil
 }
 
 // applyReplaceValues is the operator-level entry point for replace_values;
 // it delegates to replaceValues and returns the replaced value plus the list
 // of original strings that were changed.
-func applyReplaceValues(input any, replace layerReplaceValues) (any, []string) {
+func applyReplaceValues(input *yaml.Node, replace layerReplaceValues) (*yaml.Node, []string) {
 	return replaceValues(input, replace.old, replace.new, replace.recursive)
 }
 
-func replaceValues(input any, old string, new string, recursive bool) (any, []string) {
-	s, ok := input.(string)
-	if ok {
+func replaceValues(input *yaml.Node, old string, new string, recursive bool) (*yaml.Node, []string) {
+	if s, ok := stringValue(input); ok {
 		replaced := strings.ReplaceAll(s, old, new)
 		if replaced != s {
-			return replaced, []string{s}
+			return withScalarValue(input, replaced), []string{s}
 		}
-		return replaced, nil
+		return input, nil
 	}
 
-	m, ok := input.(map[string]any)
-	if ok {
-		out := make(map[string]any, len(m))
+	if isMappingNode(input) {
+		out := make([]*yaml.Node, len(input.Content))
 		originals := make([]string, 0)
-		for k, v := range m {
-			if recursive {
-				replaced, childOriginals := replaceValues(v, old, new, true)
-				out[k] = replaced
-				originals = append(originals, childOriginals...)
-				continue
-			}
-			if sv, isString := v.(string); isString {
-				replaced := strings.ReplaceAll(sv, old, new)
-				if replaced != sv {
-					originals = append(originals, sv)
-				}
-				out[k] = replaced
-				continue
-			}
-			out[k] = v
+		for i := 0; i+1 < len(input.Content); i += 2 {
+			out[i] = input.Content[i]
+			replaced, childOriginals := replaceChildValue(input.Content[i+1], old, new, recursive)
+			out[i+1] = replaced
+			originals = append(originals, childOriginals...)
 		}
-		return out, originals
+		return withContent(input, out), originals
 	}
 
-	list, ok := input.([]any)
-	if ok {
-		out := make([]any, len(list))
+	if isSequenceNode(input) {
+		out := make([]*yaml.Node, len(input.Content))
 		originals := make([]string, 0)
-		for i, v := range list {
-			if recursive {
-				replaced, childOriginals := replaceValues(v, old, new, true)
-				out[i] = replaced
-				originals = append(originals, childOriginals...)
-				continue
-			}
-			if sv, isString := v.(string); isString {
-				replaced := strings.ReplaceAll(sv, old, new)
-				if replaced != sv {
-					originals = append(originals, sv)
-				}
-				out[i] = replaced
-				continue
-			}
-			out[i] = v
+		for i, v := range input.Content {
+			replaced, childOriginals := replaceChildValue(v, old, new, recursive)
+			out[i] = replaced
+			originals = append(originals, childOriginals...)
 		}
-		return out, originals
+		return withContent(input, out), originals
 	}
 
 	return input, nil
 }
 
-func getFilterCandidate(item any, matchPath []string) (string, error) {
+func replaceChildValue(v *yaml.Node, old string, new string, recursive bool) (*yaml.Node, []string) {
+	if recursive {
+		return replaceValues(v, old, new, true)
+	}
+	if sv, isString := stringValue(v); isString {
+		replaced := strings.ReplaceAll(sv, old, new)
+		if replaced != sv {
+			return withScalarValue(v, replaced), []string{sv}
+		}
+	}
+	return v, nil
+}
+
+func getFilterCandidate(item *yaml.Node, matchPath []string) (string, error) {
 	if len(matchPath) == 0 {
-		if _, isObject := item.(map[string]any); isObject {
+		if isMappingNode(item) {
 			return "", fmt.Errorf("object list requires transform.list_filter.match_path")
 		}
-		s, ok := item.(string)
+		s, ok := stringValue(item)
 		if !ok {
 			return "", fmt.Errorf("expected string list item")
 		}
 		return s, nil
 	}
 
-	m, ok := item.(map[string]any)
-	if !ok {
+	if !isMappingNode(item) {
 		return "", fmt.Errorf("expected object list item for match_path %q", normalizePath(matchPath))
 	}
 
-	v, ok := getValueAtPath(m, matchPath)
+	v, ok := getValueAtPath(item, matchPath)
 	if !ok {
 		return "", fmt.Errorf("match_path %q not found", normalizePath(matchPath))
 	}
 
-	s, ok := v.(string)
+	s, ok := stringValue(v)
 	if !ok {
 		return "", fmt.Errorf("match_path %q must resolve to string", normalizePath(matchPath))
 	}
@@ -268,37 +263,31 @@ func shouldKeepCandidate(candidate string, include []*regexp.Regexp, exclude []*
 	return true
 }
 
-func isEmptyValue(v any) bool {
-	if v == nil {
+func isEmptyValue(v *yaml.Node) bool {
+	if isNullNode(v) {
 		return true
 	}
 
-	s, ok := v.(string)
-	if ok {
+	if s, ok := stringValue(v); ok {
 		return s == ""
 	}
 
-	m, ok := v.(map[string]any)
-	if ok {
-		return len(m) == 0
-	}
-
-	list, ok := v.([]any)
-	if ok {
-		return len(list) == 0
+	if isMappingNode(v) || isSequenceNode(v) {
+		return len(v.Content) == 0
 	}
 
 	return false
 }
 
-func matchesListRemoveCondition(value any, remove layerListRemove) (bool, error) {
+func matchesListRemoveCondition(value *yaml.Node, remove layerListRemove) (bool, error) {
 	switch remove.predicate {
 	case listRemovePredicateIsEmpty:
 		return isEmptyValue(value), nil
 	case listRemovePredicateEquals:
-		return reflect.DeepEqual(value, remove.value), nil
+		return nodeEquals(value, remove.value)
 	case listRemovePredicateNotEquals:
-		return !reflect.DeepEqual(value, remove.value), nil
+		matched, err := nodeEquals(value, remove.value)
+		return !matched, err
 	case listRemovePredicateHas:
 		return valueHas(value, remove.value)
 	case listRemovePredicateHasNot:
@@ -308,7 +297,16 @@ func matchesListRemoveCondition(value any, remove layerListRemove) (bool, error)
 	}
 }
 
-func valueHasNot(value any, expected any) (bool, error) {
+// nodeEquals reports whether n decodes to a value deeply equal to expected.
+func nodeEquals(n *yaml.Node, expected any) (bool, error) {
+	actual, err := decodeNodeValue(n)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(actual, expected), nil
+}
+
+func valueHasNot(value *yaml.Node, expected any) (bool, error) {
 	matched, err := valueHas(value, expected)
 	if err != nil {
 		return false, err
@@ -316,8 +314,8 @@ func valueHasNot(value any, expected any) (bool, error) {
 	return !matched, nil
 }
 
-func valueHas(value any, expected any) (bool, error) {
-	if s, ok := value.(string); ok {
+func valueHas(value *yaml.Node, expected any) (bool, error) {
+	if s, ok := stringValue(value); ok {
 		expectedString, ok := expected.(string)
 		if !ok {
 			return false, fmt.Errorf("when.has/has_not requires string expected value when match_path resolves to string")
@@ -325,43 +323,27 @@ func valueHas(value any, expected any) (bool, error) {
 		return strings.Contains(s, expectedString), nil
 	}
 
-	if list, ok := value.([]any); ok {
-		for _, item := range list {
-			if reflect.DeepEqual(item, expected) {
+	if isSequenceNode(value) {
+		for _, item := range value.Content {
+			matched, err := nodeEquals(item, expected)
+			if err != nil {
+				return false, err
+			}
+			if matched {
 				return true, nil
 			}
 		}
 		return false, nil
 	}
 
-	if m, ok := value.(map[string]any); ok {
+	if isMappingNode(value) {
 		expectedKey, ok := expected.(string)
 		if !ok {
 			return false, fmt.Errorf("when.has/has_not requires string expected value when match_path resolves to object")
 		}
-		_, found := m[expectedKey]
+		_, found := mappingValue(value, expectedKey)
 		return found, nil
 	}
 
 	return false, fmt.Errorf("when.has/has_not requires match_path to resolve to string, list, or object")
 }
-
-func cloneAny(v any) any {
-	if m, ok := v.(map[string]any); ok {
-		out := make(map[string]any, len(m))
-		for k, child := range m {
-			out[k] = cloneAny(child)
-		}
-		return out
-	}
-
-	if list, ok := v.([]any); ok {
-		out := make([]any, len(list))
-		for i, child := range list {
-			out[i] = cloneAny(child)
-		}
-		return out
-	}
-
-	return v
-}
@@ -2,9 +2,13 @@ package compose
 
 import (
 	"regexp"
+
+	"gopkg.in/yaml.v3"
 )
 
-type marshalFunc func(any) ([]byte, error)
+// MarshalFunc renders the composed document.  It receives the document as a
+// *yaml.Node so key order, comments and scalar styles are available.
+type MarshalFunc func(any) ([]byte, error)
 
 const yamlOutputIndentSpaces = 2
 
@@ -13,19 +17,34 @@ type mapMergeStrategy string
 const (
 	mapMergeDeep     mapMergeStrategy = "deep"
 	mapMergeOverride mapMergeStrategy = "override"
+	// mapMergeKeep keeps every base value below the path; layers only add
+	// missing keys.
+	mapMergeKeep mapMergeStrategy = "keep"
+	// mapMergeStrict fails when a layer changes a value below the path.
+	mapMergeStrict mapMergeStrategy = "strict"
+	// mapMergeReplaceKeys replaces the values of the keys a layer sets
+	// without merging them.
+	mapMergeReplaceKeys mapMergeStrategy = "replace_keys"
 )
 
 type listMergeStrategy string
 
 const (
-	listMergeOverride listMergeStrategy = "override"
-	listMergeAppend   listMergeStrategy = "append"
-	listMergePrepend  listMergeStrategy = "prepend"
+	listMergeOverride  listMergeStrategy = "override"
+	listMergeAppend    listMergeStrategy = "append"
+	listMergePrepend   listMergeStrategy = "prepend"
+	listMergeByKey     listMergeStrategy = "merge_by"
+	listMergeUnion     listMergeStrategy = "union"
+	listMergeIntersect listMergeStrategy = "intersect"
+	listMergeSubtract  listMergeStrategy = "subtract"
 )
 
 type mergeStrategy struct {
 	Map  mapMergeStrategy
 	List listMergeStrategy
+	// Key holds the paths of the fields identifying list items for
+	// listMergeByKey, relative to the item.
+	Key [][]string
 }
 
 var defaultMergeStrategy = mergeStrategy{
@@ -34,11 +53,15 @@ var defaultMergeStrategy = mergeStrategy{
 }
 
 type layerMetadata struct {
+	Profiles  []string                `yaml:"profiles"`
+	Tags      []string                `yaml:"tags"`
+	When      string                  `yaml:"when"`
 	Operators []layerOperatorMetadata `yaml:"operators"`
 }
 
 type layerOperatorMetadata struct {
 	Kind        string                     `yaml:"kind"`
+	When        string                     `yaml:"when"`
 	Source      layerTransformSource       `yaml:"source"`
 	Target      layerTransformTarget       `yaml:"target"`
 	Merge       mergeMetadata              `yaml:"merge"`
@@ -56,11 +79,14 @@ type mergeMetadata struct {
 type mergeMetadataStrategy struct {
 	Map  string `yaml:"map"`
 	List string `yaml:"list"`
+	// Key is a field path or a list of field paths; see mergeStrategy.Key.
+	Key any `yaml:"key"`
 }
 
 type layerMergeStrategy struct {
 	defaults mergeStrategy
-	paths    map[string]mergeStrategy
+	// paths holds the merge.paths rules; nil when there are none.
+	paths *mergePathTrie
 }
 
 type layerTransformMetadata struct {
@@ -141,6 +167,13 @@ type layerTransform struct {
 	listRemove           layerListRemove
 	replaceVals          layerReplaceValues
 	merge                layerMergeStrategy
+	implicit             bool
+	// when skips the operator unless it holds; nil always holds.
+	when *whenExpr
+	// index and node locate the operator in the layer's operators metadata;
+	// node is nil for the implicit merge operator.
+	index int
+	node  *yaml.Node
 }
 
 type parsedOperatorSource struct {
@@ -0,0 +1,79 @@
+package compose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Validate checks the base file and every layer without composing them.  It
+// parses every layer, builds every operator, checks that every source.file
+// exists and that every path parses.  All problems are reported at once in a
+// *ValidationError; nil means the layer stack is valid.
+func (c *Compose) Validate() error {
+	return c.ValidateContext(context.Background())
+}
+
+// ValidateContext is Validate giving up with ctx.Err() once ctx is done, like
+// RunContext.
+func (c *Compose) ValidateContext(ctx context.Context) error {
+	layers, errs := c.layerStack()
+
+	run := c.newRun()
+	if _, _, err := run.loadBase(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, spec := range layers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		errs = append(errs, run.validateLayer(spec)...)
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+func (c *composeRun) validateLayer(spec layerSpec) []error {
+	layer, errs := c.loadLayer(spec)
+	for _, operator := range layer.operators {
+		if operator.sourceFrom != transformSourceFile {
+			continue
+		}
+
+		resolvedPath := c.resolveSourcePath(operator.sourceFile)
+		if _, err := c.fs.Stat(resolvedPath); err != nil {
+			errs = append(errs, missingSourceFileError(operator, resolvedPath, err))
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errorLine(errs[i]) < errorLine(errs[j])
+	})
+	for i, err := range errs {
+		errs[i] = withLayer(err, spec.name, spec.path)
+	}
+	return errs
+}
+
+// missingSourceFileError reports an unreadable source.file at the position
+// of the operator's source.file field.
+func missingSourceFileError(operator layerTransform, resolvedPath string, err error) error {
+	index := operator.index
+	fieldPrefix := fmt.Sprintf("operators[%d]", index)
+	sourceErr := &SourceFileError{Operator: index, File: resolvedPath, Op: "read", Err: err}
+	configErr := fieldError(fieldPrefix+".source.file", fmt.Errorf("invalid %s.source.file %q: %w", fieldPrefix, operator.sourceFile, sourceErr))
+	return newLayerParseError(newOperatorConfigError(index, fieldPrefix, operator.node, configErr))
+}
+
+func errorLine(err error) int {
+	var parseErr *LayerParseError
+	if errors.As(err, &parseErr) {
+		return parseErr.Line
+	}
+	return 0
+}
@@ -0,0 +1,424 @@
+package compose
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// whenExpr is a parsed "when" clause of a layer or an operator, such as
+// `vars.ENV == "prod" && state.app.db.enabled`.
+//
+// Operands are string, number, true, false and null literals, template
+// variables (vars.NAME) and composed state values (state.PATH, using the
+// path syntax of operators).  A missing variable or path is null.  "==" and
+// "!=" compare strings, including every variable, by their text, so
+// vars.REPLICAS == 3 holds for --var REPLICAS=3; other scalars and
+// collections compare by their decoded values, so state.on == true holds
+// for `on: True` and 1 == 1.0.  "&&", "||", "!" and parentheses combine
+// conditions; null, false, 0, the strings "", "false" and "0" and empty
+// collections are false, everything else is true.
+type whenExpr struct {
+	source string
+	root   whenNode
+}
+
+// whenScope is what a when clause is evaluated against.
+type whenScope struct {
+	vars  map[string]string
+	state *yaml.Node
+}
+
+type whenNode interface {
+	eval(scope whenScope) *yaml.Node
+}
+
+// parseWhen parses a when clause; an empty clause yields nil, which always
+// matches.
+func parseWhen(source string) (*whenExpr, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, nil
+	}
+
+	tokens, err := lexWhen(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &whenParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != whenTokenEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.offset)
+	}
+	return &whenExpr{source: source, root: root}, nil
+}
+
+// match reports whether the clause holds in scope.  A nil clause always
+// matches.
+func (e *whenExpr) match(scope whenScope) bool {
+	if e == nil {
+		return true
+	}
+	return whenTruthy(e.root.eval(scope))
+}
+
+// whenScope returns the scope when clauses are evaluated in against state.
+func (c *Compose) whenScope(state *yaml.Node) whenScope {
+	return whenScope{vars: c.tplVars, state: state}
+}
+
+type whenTokenKind int
+
+const (
+	whenTokenEOF whenTokenKind = iota
+	whenTokenOperator
+	whenTokenString
+	whenTokenNumber
+	whenTokenWord
+)
+
+type whenToken struct {
+	kind   whenTokenKind
+	text   string
+	offset int
+}
+
+// lexWhen splits a when clause into tokens.  Words run up to whitespace or
+// an operator character; brackets in words may hold anything, so paths such
+// as state.servers[name=api].port are one word.
+func lexWhen(source string) ([]whenToken, error) {
+	tokens := make([]whenToken, 0)
+	for i := 0; i < len(source); {
+		ch := source[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case strings.HasPrefix(source[i:], "&&"), strings.HasPrefix(source[i:], "||"),
+			strings.HasPrefix(source[i:], "=="), strings.HasPrefix(source[i:], "!="):
+			tokens = append(tokens, whenToken{kind: whenTokenOperator, text: source[i : i+2], offset: i})
+			i += 2
+		case ch == '!' || ch == '(' || ch == ')':
+			tokens = append(tokens, whenToken{kind: whenTokenOperator, text: string(ch), offset: i})
+			i++
+		case ch == '"' || ch == '\'':
+			text, end, err := lexWhenString(source, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, whenToken{kind: whenTokenString, text: text, offset: i})
+			i = end
+		default:
+			end, err := lexWhenWord(source, i)
+			if err != nil {
+				return nil, err
+			}
+			kind := whenTokenWord
+			if _, err := strconv.ParseFloat(source[i:end], 64); err == nil {
+				kind = whenTokenNumber
+			}
+			tokens = append(tokens, whenToken{kind: kind, text: source[i:end], offset: i})
+			i = end
+		}
+	}
+	return append(tokens, whenToken{kind: whenTokenEOF, offset: len(source)}), nil
+}
+
+// lexWhenString reads the quoted string starting at start and returns its
+// value and the offset after the closing quote.  Double-quoted strings use
+// Go escapes; single-quoted strings are raw.
+func lexWhenString(source string, start int) (string, int, error) {
+	quote := source[start]
+	for i := start + 1; i < len(source); i++ {
+		switch source[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			if quote == '\'' {
+				return source[start+1 : i], i + 1, nil
+			}
+			value, err := strconv.Unquote(source[start : i+1])
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string at offset %d: %w", start, err)
+			}
+			return value, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string at offset %d", start)
+}
+
+func lexWhenWord(source string, start int) (int, error) {
+	i := start
+	for i < len(source) {
+		switch ch := source[i]; ch {
+		case ' ', '\t', '\n', '\r', '(', ')', '!', '=', '&', '|', '"', '\'':
+			if i == start {
+				return 0, fmt.Errorf("unexpected %q at offset %d", ch, i)
+			}
+			return i, nil
+		case '\\':
+			i += 2
+		case '[':
+			end := strings.IndexByte(source[i:], ']')
+			if end < 0 {
+				return 0, fmt.Errorf("unterminated [ at offset %d", i)
+			}
+			i += end + 1
+		default:
+			i++
+		}
+	}
+	return min(i, len(source)), nil
+}
+
+type whenParser struct {
+	tokens []whenToken
+	pos    int
+}
+
+func (p *whenParser) peek() whenToken {
+	return p.tokens[p.pos]
+}
+
+// accept consumes the next token when it is the operator op.
+func (p *whenParser) accept(op string) bool {
+	tok := p.peek()
+	if tok.kind == whenTokenOperator && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *whenParser) parseOr() (whenNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = whenOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *whenParser) parseAnd() (whenNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = whenAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *whenParser) parseNot() (whenNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return whenNot{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *whenParser) parseComparison() (whenNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!="} {
+		if p.accept(op) {
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return whenCompare{left: left, right: right, negate: op == "!="}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *whenParser) parseOperand() (whenNode, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case whenTokenEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case whenTokenString:
+		p.pos++
+		return whenLiteral{value: newStringNode(tok.text)}, nil
+	case whenTokenNumber:
+		p.pos++
+		n := &yaml.Node{Kind: yaml.ScalarNode, Value: tok.text}
+		n.Tag = n.ShortTag()
+		return whenLiteral{value: n}, nil
+	case whenTokenOperator:
+		if !p.accept("(") {
+			return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.offset)
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			next := p.peek()
+			return nil, fmt.Errorf("expected ) at offset %d", next.offset)
+		}
+		return inner, nil
+	}
+
+	p.pos++
+	switch tok.text {
+	case "true", "false":
+		return whenLiteral{value: newBoolNode(tok.text == "true")}, nil
+	case "null":
+		return whenLiteral{}, nil
+	}
+	if name, ok := strings.CutPrefix(tok.text, "vars."); ok && name != "" {
+		return whenVar{name: name}, nil
+	}
+	if rawPath, ok := strings.CutPrefix(tok.text, "state."); ok {
+		path, err := parseDotPath(rawPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state path %q: %w", rawPath, err)
+		}
+		return whenState{path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown operand %q at offset %d: expected a literal, vars.NAME or state.PATH", tok.text, tok.offset)
+}
+
+type whenLiteral struct{ value *yaml.Node }
+
+func (n whenLiteral) eval(whenScope) *yaml.Node { return n.value }
+
+type whenVar struct{ name string }
+
+func (n whenVar) eval(scope whenScope) *yaml.Node {
+	value, ok := scope.vars[n.name]
+	if !ok {
+		return nil
+	}
+	return newStringNode(value)
+}
+
+type whenState struct{ path []string }
+
+func (n whenState) eval(scope whenScope) *yaml.Node {
+	value, _ := getValueAtPath(scope.state, n.path)
+	return value
+}
+
+type whenNot struct{ operand whenNode }
+
+func (n whenNot) eval(scope whenScope) *yaml.Node {
+	return newBoolNode(!whenTruthy(n.operand.eval(scope)))
+}
+
+type whenAnd struct{ left, right whenNode }
+
+func (n whenAnd) eval(scope whenScope) *yaml.Node {
+	return newBoolNode(whenTruthy(n.left.eval(scope)) && whenTruthy(n.right.eval(scope)))
+}
+
+type whenOr struct{ left, right whenNode }
+
+func (n whenOr) eval(scope whenScope) *yaml.Node {
+	return newBoolNode(whenTruthy(n.left.eval(scope)) || whenTruthy(n.right.eval(scope)))
+}
+
+type whenCompare struct {
+	left, right whenNode
+	negate      bool
+}
+
+func (n whenCompare) eval(scope whenScope) *yaml.Node {
+	return newBoolNode(whenEqual(n.left.eval(scope), n.right.eval(scope)) != n.negate)
+}
+
+func newBoolNode(b bool) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(b)}
+}
+
+// whenEqual compares two operands: nulls are equal, scalars by their text
+// when either is a string, numbers by their value and everything else by
+// its decoded value.
+func whenEqual(a *yaml.Node, b *yaml.Node) bool {
+	if isNullNode(a) || isNullNode(b) {
+		return isNullNode(a) && isNullNode(b)
+	}
+	if a.Kind != b.Kind {
+		return false
+	}
+	if a.Kind == yaml.ScalarNode && (a.ShortTag() == "!!str" || b.ShortTag() == "!!str") {
+		return a.Value == b.Value
+	}
+	av, aerr := decodeNodeValue(a)
+	bv, berr := decodeNodeValue(b)
+	if aerr != nil || berr != nil {
+		return false
+	}
+	if an, ok := whenNumber(av); ok {
+		bn, ok := whenNumber(bv)
+		return ok && an == bn
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+func whenTruthy(n *yaml.Node) bool {
+	if isNullNode(n) {
+		return false
+	}
+	if n.Kind != yaml.ScalarNode {
+		return len(n.Content) > 0
+	}
+	if n.ShortTag() == "!!str" {
+		switch n.Value {
+		case "", "false", "0":
+			return false
+		default:
+			return true
+		}
+	}
+	v, err := decodeNodeValue(n)
+	if err != nil {
+		return true
+	}
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	if number, ok := whenNumber(v); ok {
+		return number != 0
+	}
+	return true
+}
+
+// whenNumber returns v as a float64 when it is a decoded YAML number.
+func whenNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}